@@ -6,34 +6,61 @@
 package main
 
 import (
-	"io"
 	"os"
 	"http"
 	"fmt"
 	"path"
+	"sync"
 	"time"
+	"strings"
 )
 
-const (
-	AUR_ROOT = "http://aur.archlinux.org"
-)
+// Where source packages are downloaded from. Tests use a fake AUR.
+var AUR_ROOT = "http://aur.archlinux.org"
 
 type AURCache struct {
 	srcpkgdest string
 	buildroot  string
-	builder    *PackageBuilder
+	builder    Builder
+	policy     SecurityPolicy
+	localrepo  *LocalRepo // built packages are added to this repo, if not nil
+	owner      *BuildUser // downloaded and extracted files are given to this user
+	localdb    *LocalDB   // built packages are checked against this, if not nil
+	owners     map[string]string
+	ownersOnce sync.Once
+	built      map[string]*BinPkg // the packages we built, by path
+	builtLock  sync.Mutex
+}
+
+func NewAURCache(srcdest, buildroot string, builder Builder, policy SecurityPolicy) *AURCache {
+	return &AURCache{srcpkgdest: srcdest, buildroot: buildroot, builder: builder,
+		policy: policy, built: make(map[string]*BinPkg)}
+}
+
+// UseLocalRepo makes the AURCache add every package it builds to repo. The
+// copies in the repo are what Fetch returns.
+func (aur *AURCache) UseLocalRepo(repo *LocalRepo) {
+	aur.localrepo = repo
 }
 
-func NewAURCache(srcdest, buildroot string, builder *PackageBuilder) *AURCache {
-	return &AURCache{srcdest, buildroot, builder}
+// GiveFilesTo makes the AURCache chown the source packages it downloads and
+// the build dirs it extracts to user, who can then build them.
+func (aur *AURCache) GiveFilesTo(user *BuildUser) {
+	aur.owner = user
+}
+
+// UseLocalDB makes the AURCache warn about files in the packages it builds that
+// belong to packages installed according to db.
+func (aur *AURCache) UseLocalDB(db *LocalDB) {
+	aur.localdb = db
 }
 
 func (aur *AURCache) srcPkgPath(pkgname string) string {
 	return fmt.Sprintf("%s/%s.src.tar.gz", aur.srcpkgdest, pkgname)
 }
 
-func (aur *AURCache) Fetch(pkgname string) ([]string, FetchError) {
-	srcpath, err := aur.downloadNewer(pkgname)
+func (aur *AURCache) Fetch(cn *Canceler, pkgname string) ([]string, FetchError) {
+	srcpath, err := aur.downloadNewer(cn, pkgname)
 	if err != nil {
 		return nil, FetchErrorWrap(pkgname, err)
 	}
@@ -41,49 +68,230 @@ func (aur *AURCache) Fetch(pkgname string) ([]string, FetchError) {
 		return nil, NotFoundError(pkgname)
 	}
 
-	srcpkg, err := OpenSrcPkg(srcpath)
+	srcpkg, err := OpenSrcPkg(cn, srcpath)
 	if err != nil {
 		return nil, FetchErrorWrap(pkgname, err)
 	}
 
-	// If we are running under sudo, we do not want our files to be owned by root.
-	uid, gid := lookupSudoUser()
-	if uid != 0 {
-		os.Chown(srcpath, uid, gid)
-	}
-
 	srcdir, err := srcpkg.Extract(aur.buildroot)
 	srcpkg.Close()
 	if err != nil {
 		return nil, FetchErrorWrap(pkgname, err)
 	}
 
-	if uid != 0 {
-		chownDirRec(srcdir, uid, gid)
+	// If we are running as root, we do not want our files to be owned by root.
+	if err = aur.giveFiles(srcpath, srcdir); err != nil {
+		return nil, FetchErrorWrap(pkgname, err)
+	}
+
+	if err = aur.checkSecurity(pkgname, srcdir); err != nil {
+		return nil, FetchErrorWrap(pkgname, err)
+	}
+
+	result, err := aur.builder.Build(cn, srcdir)
+	if result != nil {
+		// Builders running as root (in a chroot) leave root-owned files behind.
+		allpaths := append(append([]string{}, result.LogPaths...), result.PkgPaths...)
+		if giveerr := aur.giveFiles(allpaths...); giveerr != nil && err == nil {
+			err = giveerr
+		}
+	}
+	if err != nil {
+		if result != nil {
+			for _, logpath := range result.LogPaths {
+				fmt.Printf("%s build log: %s\n", pkgname, logpath)
+			}
+		}
+		return nil, FetchErrorWrap(pkgname, err)
 	}
+	pkgpaths := result.PkgPaths
 
-	pkgpaths, err := aur.builder.Build(srcdir)
+	pkgs, err := aur.inspectBuilt(cn, srcdir, pkgpaths)
 	if err != nil {
 		return nil, FetchErrorWrap(pkgname, err)
 	}
 
+	if aur.localrepo != nil {
+		if pkgpaths, err = aur.localrepo.Add(cn, pkgpaths); err != nil {
+			return nil, FetchErrorWrap(pkgname, err)
+		}
+	}
+
+	aur.builtLock.Lock()
+	for i, pkgpath := range pkgpaths {
+		aur.built[pkgpath] = pkgs[i]
+	}
+	aur.builtLock.Unlock()
 	return pkgpaths, nil
 }
 
-func chownDirRec(dir string, uid, gid int) {
-	dirh, err := os.Open(dir)
+// checkSecurity prints a summary of the security issues of the PKGBUILD in
+// srcdir. If our policy says so, an error is returned if there are any.
+func (aur *AURCache) checkSecurity(pkgname, srcdir string) os.Error {
+	vars, err := ReadPkgbuild(srcdir)
+	if err != nil {
+		return err
+	}
+
+	issues := CheckPkgbuild(vars)
+	printSecurityIssues(pkgname, issues)
+	if len(issues) > 0 && aur.policy == PolicyRefuse {
+		return os.NewError("refusing to build a package with security issues")
+	}
+	return nil
+}
+
+// inspectBuilt looks inside the packages built from srcdir. Each must contain
+// the package its filename says, and that package must be one the PKGBUILD
+// makes. Files in odd places or belonging to other packages are warned about.
+// The packages are returned in the same order as pkgpaths.
+func (aur *AURCache) inspectBuilt(cn *Canceler, srcdir string, pkgpaths []string) ([]*BinPkg, os.Error) {
+	vars, err := ReadPkgbuild(srcdir)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgs := make([]*BinPkg, len(pkgpaths))
+	for i, pkgpath := range pkgpaths {
+		pkg, err := ReadBinPkg(cn, pkgpath)
+		if err != nil {
+			return nil, err
+		}
+		pkgname, version := parsePkgFilename(path.Base(pkgpath))
+		if err = pkg.Verify(pkgname, version); err != nil {
+			return nil, err
+		}
+		switch made, unsure := madeByPkgbuild(vars, pkg.Name()); {
+		case !made && unsure:
+			fmt.Printf("warning: can't tell if %s is one of the PKGBUILD's packages\n",
+				path.Base(pkgpath))
+		case !made:
+			return nil, os.NewError(path.Base(pkgpath) + " is not one of the PKGBUILD's packages")
+		}
+
+		warnings := pkg.CheckFiles(aur.fileOwners())
+		fmt.Printf(":: Built %s %s (%d files)\n", pkg.Name(), pkg.Version(),
+			len(pkg.FileList()))
+		for _, warning := range warnings {
+			fmt.Printf("warning: %s: %s\n", pkg.Name(), warning)
+		}
+		pkgs[i] = pkg
+	}
+	return pkgs, nil
+}
+
+// BuiltPkg returns the package at pkgpath if we built it, or nil. Packages that
+// were added to the local repo are found by the path of the copy in the repo.
+func (aur *AURCache) BuiltPkg(pkgpath string) *BinPkg {
+	aur.builtLock.Lock()
+	defer aur.builtLock.Unlock()
+	return aur.built[pkgpath]
+}
+
+// madeByPkgbuild returns true if pkgname is one of the packages the PKGBUILD
+// with vars makes, or the -debug package makepkg splits off. That is named
+// after the pkgbase, which defaults to the first pkgname. If the PKGBUILD has
+// names we couldn't expand without running it, or no pkgnames at all, pkgname
+// may be one of them anyway, and unsure is true.
+func madeByPkgbuild(vars PkgbuildVars, pkgname string) (made, unsure bool) {
+	pkgnames := vars["pkgname"]
+	unsure = len(pkgnames) == 0
+	for _, name := range pkgnames {
+		if name == pkgname {
+			return true, false
+		}
+		if strings.IndexAny(name, "$`(){}") != -1 {
+			unsure = true
+		}
+	}
+
+	pkgbase := vars.Get("pkgbase")
+	if pkgbase == "" {
+		pkgbase = vars.Get("pkgname")
+	}
+	if pkgbase != "" && pkgname == pkgbase+"-debug" {
+		return true, false
+	}
+	if strings.IndexAny(pkgbase, "$`(){}") != -1 {
+		unsure = true
+	}
+	return false, unsure
+}
+
+// fileOwners returns the owners of installed files, read once from the local
+// DB. It is nil if we have no local DB or it can't be read.
+func (aur *AURCache) fileOwners() map[string]string {
+	aur.ownersOnce.Do(func() {
+		if aur.localdb == nil {
+			return
+		}
+		owners, err := aur.localdb.FileOwners()
+		if err != nil {
+			fmt.Printf("warning: can't check for file conflicts: %s\n", err.String())
+			return
+		}
+		aur.owners = owners
+	})
+	return aur.owners
+}
+
+func containsString(list []string, str string) bool {
+	for _, elem := range list {
+		if elem == str {
+			return true
+		}
+	}
+	return false
+}
+
+// chownDirRec chowns dir and everything under it. dir may also be a plain
+// file. Symlinks are chowned themselves, they are not followed.
+func chownDirRec(dir string, uid, gid int) os.Error {
+	if err := os.Lchown(dir, uid, gid); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
 	if err != nil {
-		return
+		return err
+	}
+	if !info.IsDirectory() {
+		return nil
 	}
 
-	dirh.Chown(uid, gid)
-	names, err := dirh.Readdirnames(-1)
+	names, err := readDirNames(dir)
 	if err != nil {
-		return
+		return err
 	}
-	for _, entry := range names {
-		os.Chown(path.Join(dir, entry), uid, gid)
+	for _, name := range names {
+		if err := chownDirRec(path.Join(dir, name), uid, gid); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, os.Error) {
+	dirh, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer dirh.Close()
+	return dirh.Readdirnames(-1)
+}
+
+// giveFiles chowns the files at paths, and everything under them, to the
+// AURCache's owner. If there is no owner, nothing is done.
+func (aur *AURCache) giveFiles(paths ...string) os.Error {
+	if aur.owner == nil {
+		return nil
+	}
+	for _, filepath := range paths {
+		if err := chownDirRec(filepath, aur.owner.Uid, aur.owner.Gid); err != nil {
+			return os.NewError("failed to give " + filepath + " to " +
+				aur.owner.Name + ": " + err.String())
+		}
+	}
+	return nil
 }
 
 // mtimeDateStr converts the file modification time into a date string that HTTP likes.
@@ -98,7 +306,7 @@ func srcPkgUrl(pkgname string) string {
 	return fmt.Sprintf("%s/packages/%s/%s.tar.gz", AUR_ROOT, pkgname, pkgname)
 }
 
-func (aur *AURCache) downloadNewer(pkgname string) (string, os.Error) {
+func (aur *AURCache) downloadNewer(cn *Canceler, pkgname string) (string, os.Error) {
 	var mtime int64
 	path := aur.srcPkgPath(pkgname)
 	if stat, _ := os.Stat(path); stat != nil {
@@ -132,14 +340,10 @@ func (aur *AURCache) downloadNewer(pkgname string) (string, os.Error) {
 	default:
 		return "", err
 	}
-	var destfile *os.File
-	if destfile, err = os.Create(path); err != nil {
-		return "", err
-	}
-	defer destfile.Close()
-	if _, err = io.Copy(destfile, resp.Body); err != nil {
-		os.Remove(path)
+	// Closing the body on cancel interrupts the copy below.
+	if err = cn.AddCloser(resp.Body); err != nil {
 		return "", err
 	}
-	return path, nil
+	defer cn.RemoveCloser(resp.Body)
+	return saveDownload(cn, path, resp.Body, resp.ContentLength)
 }
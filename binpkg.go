@@ -0,0 +1,378 @@
+/*	binpkg.go
+	Reading built binary packages (.pkg.tar.*). Their metadata is in .PKGINFO
+	and .BUILDINFO, and the list of their files in .MTREE. We look inside the
+	packages makepkg builds before installing them.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"bytes"
+	"strings"
+	"strconv"
+	"io/ioutil"
+	"compress/gzip"
+)
+
+// Where packaged files belong. Anything else gets a warning.
+var standardPrefixes = []string{"usr/", "etc/", "opt/", "var/", "srv/", "boot/"}
+
+// The metadata files at the top of packages. They are not installed.
+var pkgMetaFiles = []string{".PKGINFO", ".BUILDINFO", ".MTREE", ".INSTALL", ".CHANGELOG"}
+
+// MtreeEntry is a file in a package's .MTREE.
+type MtreeEntry struct {
+	Path string // relative to /, without a leading ./
+	Type string // "file", "dir" or "link"
+	Mode uint32
+	Size int64
+	Link string // the target of links
+}
+
+// BinPkg is a built package file.
+type BinPkg struct {
+	Path      string
+	Info      PkgbuildVars // from .PKGINFO, which has the same format as .SRCINFO
+	BuildInfo PkgbuildVars // from .BUILDINFO, empty if the package has none
+	Files     []*MtreeEntry
+}
+
+// The largest metadata file we read from a package.
+const MaxPkgMetaSize = 16 << 20 // bytes
+
+// ReadBinPkg reads the metadata of the package file at pkgpath. makepkg puts
+// the metadata files first, so we stop reading at the first file that isn't
+// one. Decompressor commands are killed if cn is canceled.
+func ReadBinPkg(cn *Canceler, pkgpath string) (*BinPkg, os.Error) {
+	tarball, err := OpenTarball(cn, pkgpath)
+	if err != nil {
+		return nil, err
+	}
+	defer tarball.Close()
+
+	meta := make(map[string][]byte)
+	for {
+		hdr, err := tarball.Next()
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		if !isPkgMetaFile(name) {
+			break
+		}
+		if hdr.Size < 0 || hdr.Size > MaxPkgMetaSize {
+			return nil, os.NewError(path.Base(pkgpath) + ": " + name + " is too big")
+		}
+		if meta[name], err = ioutil.ReadAll(tarball); err != nil {
+			return nil, err
+		}
+	}
+
+	pkg := &BinPkg{Path: pkgpath, BuildInfo: make(PkgbuildVars)}
+	pkg.Info = parseSrcInfo(string(meta[".PKGINFO"]))
+	if pkg.Name() == "" || pkg.Version() == "" {
+		return nil, os.NewError(path.Base(pkgpath) + " has no pkgname or pkgver in .PKGINFO")
+	}
+
+	// Old packages have no .BUILDINFO.
+	if buildinfo, ok := meta[".BUILDINFO"]; ok {
+		pkg.BuildInfo = parseSrcInfo(string(buildinfo))
+	}
+
+	zipped, ok := meta[".MTREE"]
+	if !ok {
+		return nil, os.NewError(path.Base(pkgpath) + " has no .MTREE")
+	}
+	unzipper, err := gzip.NewReader(bytes.NewBuffer(zipped))
+	if err != nil {
+		return nil, err
+	}
+	mtree, err := ioutil.ReadAll(unzipper)
+	unzipper.Close()
+	if err != nil {
+		return nil, err
+	}
+	if pkg.Files, err = parseMtree(string(mtree)); err != nil {
+		return nil, os.NewError(path.Base(pkgpath) + ": " + err.String())
+	}
+
+	return pkg, nil
+}
+
+func (pkg *BinPkg) Name() string {
+	return pkg.Info.Get("pkgname")
+}
+
+// Version returns the full version: <pkgver>-<pkgrel>, with the epoch if there
+// is one.
+func (pkg *BinPkg) Version() string {
+	return pkg.Info.Get("pkgver")
+}
+
+// FileList returns the paths of the files the package installs, in the format
+// of pacman's files lists: directories end with a slash.
+func (pkg *BinPkg) FileList() []string {
+	filelist := make([]string, 0, len(pkg.Files))
+	for _, entry := range pkg.Files {
+		switch {
+		case isPkgMetaFile(entry.Path):
+			continue
+		case entry.Type == "dir":
+			filelist = append(filelist, entry.Path+"/")
+		default:
+			filelist = append(filelist, entry.Path)
+		}
+	}
+	return filelist
+}
+
+// Verify returns an error if the package is not named pkgname or its version
+// is not version.
+func (pkg *BinPkg) Verify(pkgname, version string) os.Error {
+	if pkg.Name() != pkgname || pkg.Version() != version {
+		return os.NewError(fmt.Sprintf("%s contains %s %s instead of %s %s",
+			path.Base(pkg.Path), pkg.Name(), pkg.Version(), pkgname, version))
+	}
+	return nil
+}
+
+// CheckFiles returns warnings about files in the package that are outside the
+// standard prefixes or that belong to another installed package. owners maps
+// installed files to their packages; it may be nil.
+func (pkg *BinPkg) CheckFiles(owners map[string]string) []string {
+	warnings := make([]string, 0)
+	for _, entry := range pkg.Files {
+		if isPkgMetaFile(entry.Path) {
+			continue
+		}
+		if !isStandardPath(entry.Path) {
+			warnings = append(warnings, "nonstandard path: /"+entry.Path)
+		}
+		if entry.Type == "dir" {
+			// Directories are shared.
+			continue
+		}
+		if owner, ok := owners[entry.Path]; ok && owner != pkg.Name() {
+			warnings = append(warnings, fmt.Sprintf("/%s is owned by %s", entry.Path, owner))
+		}
+	}
+	return warnings
+}
+
+// FileConflict is a file in a package we are about to install which belongs to
+// something else: another package we are installing, an installed package, or
+// nobody at all.
+type FileConflict struct {
+	PkgName string
+	Path    string
+	Owner   string // the package owning the file, "" if it is owned by nobody
+	New     bool   // the owner is one of the packages being installed
+}
+
+func (conflict *FileConflict) String() string {
+	switch {
+	case conflict.New:
+		return fmt.Sprintf("%s: /%s is in %s too", conflict.PkgName, conflict.Path,
+			conflict.Owner)
+	case conflict.Owner == "":
+		return fmt.Sprintf("%s: /%s exists in filesystem", conflict.PkgName, conflict.Path)
+	}
+	return fmt.Sprintf("%s: /%s exists in filesystem (owned by %s)", conflict.PkgName,
+		conflict.Path, conflict.Owner)
+}
+
+// FindFileConflicts returns the files in pkgs that would overwrite the files of
+// other packages, like pacman -U checks. owners maps installed files to their
+// packages. A file is not a conflict if it belongs to an older version of the
+// same package, to a package in pkgs whose new version no longer has it, or to
+// a package that one of pkgs conflicts with, which pacman removes first.
+// Replaced packages are only removed by -Su, never by -U, so they still count. Files on disk that nobody owns are conflicts too; root is where the
+// files are installed. If owners is nil, pkgs are only checked against each
+// other.
+func FindFileConflicts(pkgs []*BinPkg, owners map[string]string, root string) []*FileConflict {
+	// The files of the packages being installed, and what they will belong to.
+	newOwners := make(map[string]string)
+	conflicts := make([]*FileConflict, 0)
+
+	for _, pkg := range pkgs {
+		for _, entry := range pkg.Files {
+			if isPkgMetaFile(entry.Path) || entry.Type == "dir" {
+				continue
+			}
+			if other, ok := newOwners[entry.Path]; ok && other != pkg.Name() {
+				conflicts = append(conflicts, &FileConflict{pkg.Name(), entry.Path, other, true})
+				continue
+			}
+			newOwners[entry.Path] = pkg.Name()
+		}
+	}
+	if owners == nil {
+		return conflicts
+	}
+
+	installing := make(map[string]bool, len(pkgs))
+	removing := make(map[string]bool)
+	for _, pkg := range pkgs {
+		installing[pkg.Name()] = true
+		for _, dep := range pkg.Info["conflict"] {
+			removing[trimDepSpec(dep)] = true
+		}
+	}
+
+	for _, pkg := range pkgs {
+		for _, entry := range pkg.Files {
+			if isPkgMetaFile(entry.Path) || entry.Type == "dir" {
+				continue
+			}
+			owner, owned := owners[entry.Path]
+			switch {
+			case owned && owner == pkg.Name():
+				// An upgrade.
+			case owned && installing[owner]:
+				// Moving to us from a package being upgraded, unless the
+				// new version still has it (which we found above).
+			case owned && removing[owner]:
+				// The owner is removed before we are installed.
+			case owned:
+				conflicts = append(conflicts, &FileConflict{pkg.Name(), entry.Path, owner, false})
+			default:
+				stat, err := os.Lstat(path.Join(root, entry.Path))
+				if err == nil && !stat.IsDirectory() {
+					conflicts = append(conflicts, &FileConflict{pkg.Name(), entry.Path, "", false})
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+func isPkgMetaFile(name string) bool {
+	for _, meta := range pkgMetaFiles {
+		if name == meta {
+			return true
+		}
+	}
+	return false
+}
+
+// isStandardPath returns true if filepath is under one of the standard
+// prefixes, or is one of their top directories. /usr/local belongs to the
+// admin, not to packages.
+func isStandardPath(filepath string) bool {
+	if filepath == "usr/local" || strings.HasPrefix(filepath, "usr/local/") {
+		return false
+	}
+	for _, prefix := range standardPrefixes {
+		if filepath+"/" == prefix || strings.HasPrefix(filepath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMtree parses the mtree file list written by bsdtar. "/set" lines give
+// defaults for the keywords of the entries that follow.
+func parseMtree(text string) ([]*MtreeEntry, os.Error) {
+	defaults := make(map[string]string)
+	entries := make([]*MtreeEntry, 0, 64)
+
+	text = strings.Replace(text, "\\\n", " ", -1)
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0][0] == '#' {
+			continue
+		}
+		switch fields[0] {
+		case "/set":
+			for _, keyword := range fields[1:] {
+				key, val := splitKeyword(keyword)
+				defaults[key] = val
+			}
+			continue
+		case "/unset":
+			for _, keyword := range fields[1:] {
+				key, _ := splitKeyword(keyword)
+				defaults[key] = "", false
+			}
+			continue
+		}
+
+		keywords := make(map[string]string, len(defaults)+len(fields))
+		for key, val := range defaults {
+			keywords[key] = val
+		}
+		for _, keyword := range fields[1:] {
+			key, val := splitKeyword(keyword)
+			keywords[key] = val
+		}
+
+		name := path.Clean(unescapeMtree(fields[0]))
+		if name == "." {
+			continue
+		}
+		entry := &MtreeEntry{Path: name, Type: keywords["type"],
+			Link: unescapeMtree(keywords["link"])}
+		if mode, ok := keywords["mode"]; ok {
+			bits, err := strconv.Btoui64(mode, 8)
+			if err != nil {
+				return nil, os.NewError("invalid mode for " + name + " in .MTREE")
+			}
+			entry.Mode = uint32(bits)
+		}
+		if size, ok := keywords["size"]; ok {
+			var err os.Error
+			if entry.Size, err = strconv.Atoi64(size); err != nil {
+				return nil, os.NewError("invalid size for " + name + " in .MTREE")
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func splitKeyword(keyword string) (key, val string) {
+	if idx := strings.Index(keyword, "="); idx != -1 {
+		return keyword[:idx], keyword[idx+1:]
+	}
+	return keyword, ""
+}
+
+// unescapeMtree turns the \ooo octal escapes mtree uses for odd characters
+// back into the characters.
+func unescapeMtree(text string) string {
+	if strings.Index(text, "\\") == -1 {
+		return text
+	}
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+3 < len(text) && isOctal(text[i+1:i+4]) {
+			buf.WriteByte((text[i+1]-'0')<<6 | (text[i+2]-'0')<<3 | (text[i+3] - '0'))
+			i += 3
+			continue
+		}
+		buf.WriteByte(text[i])
+	}
+	return buf.String()
+}
+
+func isOctal(digits string) bool {
+	for _, ch := range digits {
+		if ch < '0' || ch > '7' {
+			return false
+		}
+	}
+	return true
+}
+
+// printFileList prints the files in the package like pacman -Qlp does.
+func printFileList(pkg *BinPkg) {
+	for _, filepath := range pkg.FileList() {
+		fmt.Printf("%s /%s\n", pkg.Name(), filepath)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// conflictTestPkg returns the package pkgname with the files given, which are
+// dirs if they end in "/". info is more of its .PKGINFO.
+func conflictTestPkg(pkgname, info string, files ...string) *BinPkg {
+	pkg := &BinPkg{Path: pkgname + "-1.0-1-x86_64.pkg.tar.zst",
+		Info: parseSrcInfo("pkgname = " + pkgname + "\npkgver = 1.0-1\n" + info)}
+	pkg.Files = append(pkg.Files, &MtreeEntry{Path: ".PKGINFO", Type: "file"})
+	for _, file := range files {
+		entry := &MtreeEntry{Path: file, Type: "file"}
+		if strings.HasSuffix(file, "/") {
+			entry.Path, entry.Type = file[:len(file)-1], "dir"
+		}
+		pkg.Files = append(pkg.Files, entry)
+	}
+	return pkg
+}
+
+var conflictTests = []struct {
+	name   string
+	pkgs   []*BinPkg
+	owners map[string]string // nil if there is no local DB
+	disk   map[string]string // files under root, see writeCacheFiles
+	want   []string
+}{
+	{"new files", []*BinPkg{conflictTestPkg("foo", "", "usr/", "usr/bin/", "usr/bin/foo")},
+		map[string]string{"usr/bin/bar": "bar"}, nil, nil},
+	{"owned by another package", []*BinPkg{conflictTestPkg("foo", "", "usr/bin/foo")},
+		map[string]string{"usr/bin/foo": "bar"}, nil,
+		[]string{"foo: /usr/bin/foo exists in filesystem (owned by bar)"}},
+	{"upgrade", []*BinPkg{conflictTestPkg("foo", "", "usr/bin/foo")},
+		map[string]string{"usr/bin/foo": "foo"}, map[string]string{"usr/bin/foo": "old"}, nil},
+	{"unowned file on disk", []*BinPkg{conflictTestPkg("foo", "", "usr/bin/foo")},
+		map[string]string{}, map[string]string{"usr/bin/foo": "made by hand"},
+		[]string{"foo: /usr/bin/foo exists in filesystem"}},
+	{"unowned dir on disk", []*BinPkg{conflictTestPkg("foo", "", "usr/lib/foo")},
+		map[string]string{}, map[string]string{"usr/lib/foo/": ""}, nil},
+	{"shared directories", []*BinPkg{conflictTestPkg("foo", "", "usr/", "usr/share/doc/"),
+		conflictTestPkg("bar", "", "usr/", "usr/share/doc/")},
+		map[string]string{"usr/share/doc": "filesystem"},
+		map[string]string{"usr/share/doc/": ""}, nil},
+	{"between new packages", []*BinPkg{conflictTestPkg("foo", "", "usr/bin/x"),
+		conflictTestPkg("bar", "", "usr/bin/x")},
+		map[string]string{}, nil, []string{"bar: /usr/bin/x is in foo too"}},
+	{"between new packages without a local DB",
+		[]*BinPkg{conflictTestPkg("foo", "", "usr/bin/x"), conflictTestPkg("bar", "", "usr/bin/x")},
+		nil, map[string]string{"usr/bin/x": "unowned"}, []string{"bar: /usr/bin/x is in foo too"}},
+	{"moved between new packages", []*BinPkg{conflictTestPkg("foo", "", "usr/bin/x"),
+		conflictTestPkg("bar", "")},
+		map[string]string{"usr/bin/x": "bar"}, map[string]string{"usr/bin/x": ""}, nil},
+	{"conflicting package", []*BinPkg{conflictTestPkg("foo", "conflict = bar>=2\n", "usr/bin/x")},
+		map[string]string{"usr/bin/x": "bar"}, map[string]string{"usr/bin/x": ""}, nil},
+	{"replaced package", []*BinPkg{conflictTestPkg("foo", "replaces = bar\n", "usr/bin/x")},
+		map[string]string{"usr/bin/x": "bar"}, map[string]string{"usr/bin/x": ""},
+		[]string{"foo: /usr/bin/x exists in filesystem (owned by bar)"}},
+}
+
+func TestFindFileConflicts(t *testing.T) {
+	for _, test := range conflictTests {
+		root := tempDir(t)
+		writeCacheFiles(t, root, test.disk)
+
+		conflicts := FindFileConflicts(test.pkgs, test.owners, root)
+		got := make([]string, len(conflicts))
+		for i, conflict := range conflicts {
+			got[i] = conflict.String()
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got conflicts %q, want %q", test.name, got, test.want)
+		}
+		os.RemoveAll(root)
+	}
+}
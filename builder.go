@@ -0,0 +1,46 @@
+/*	builder.go
+	The Builder interface, which turns an extracted source package into binary
+	packages. PackageBuilder builds on the host and ChrootBuilder builds inside
+	a clean chroot. Tests use a fake one.
+*/
+
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"io/ioutil"
+)
+
+// BuildResult is what a Builder made: the paths of the built packages and of
+// the log files of the build.
+type BuildResult struct {
+	PkgPaths []string
+	LogPaths []string
+}
+
+// A Builder builds the package in srcdir. Long-running builds must register
+// with cn so that they can be interrupted. If the build fails, the result may
+// still be returned along with the error so that the logs can be shown.
+type Builder interface {
+	Build(cn *Canceler, srcdir string) (*BuildResult, os.Error)
+}
+
+// findBuildLogs returns the makepkg log files (written with makepkg -L) in
+// srcdir that were modified at or after since, in seconds.
+func findBuildLogs(srcdir string, since int64) []string {
+	infos, err := ioutil.ReadDir(srcdir)
+	if err != nil {
+		return nil
+	}
+
+	logpaths := make([]string, 0, 4)
+	for _, info := range infos {
+		if info.IsRegular() && strings.HasSuffix(info.Name, ".log") &&
+			info.Mtime_ns/1000000000 >= since {
+			logpaths = append(logpaths, path.Join(srcdir, info.Name))
+		}
+	}
+	return logpaths
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"http"
+	"path"
+	"sync"
+	"time"
+	"bytes"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"archive/tar"
+	"http/httptest"
+	"compress/gzip"
+)
+
+// FakeBuilder doesn't build anything. It returns the package paths it was
+// created with (or its error) and remembers which source dirs it was asked to
+// build, so that code using a Builder can be tested without makepkg.
+type FakeBuilder struct {
+	PkgPaths []string
+	Error    os.Error
+	built    []string
+	lock     sync.Mutex
+}
+
+func (fb *FakeBuilder) Build(cn *Canceler, srcdir string) (*BuildResult, os.Error) {
+	if cn.Canceled() {
+		return nil, ErrCanceled
+	}
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	fb.built = append(fb.built, srcdir)
+	if fb.Error != nil {
+		return nil, fb.Error
+	}
+	return &BuildResult{fb.PkgPaths, nil}, nil
+}
+
+// Built returns the source dirs the FakeBuilder was asked to build.
+func (fb *FakeBuilder) Built() []string {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return append([]string{}, fb.built...)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// tarEntry is an entry of a tarball written by writeTarball. Entries without a
+// Typeflag are regular files.
+type tarEntry struct {
+	Name     string
+	Typeflag byte
+	Body     string
+	Linkname string
+}
+
+// tarBytes returns an uncompressed tarball of entries.
+func tarBytes(t *testing.T, entries []tarEntry) []byte {
+	buf := bytes.NewBuffer(nil)
+	tarwtr := tar.NewWriter(buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{Name: entry.Name, Mode: 0644, Typeflag: entry.Typeflag,
+			Linkname: entry.Linkname, Mtime: time.Seconds()}
+		switch hdr.Typeflag {
+		case 0:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(entry.Body))
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		}
+		if err := tarwtr.WriteHeader(hdr); err != nil {
+			t.Fatalf("tar header for %s: %s", entry.Name, err)
+		}
+		if _, err := tarwtr.Write([]byte(entry.Body)); err != nil {
+			t.Fatalf("tar contents of %s: %s", entry.Name, err)
+		}
+	}
+	if err := tarwtr.Close(); err != nil {
+		t.Fatalf("tarball: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// tarballBytes returns a gzipped tarball of entries.
+func tarballBytes(t *testing.T, entries []tarEntry) []byte {
+	buf := bytes.NewBuffer(nil)
+	zipper, err := gzip.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("gzip: %s", err)
+	}
+	if _, err = zipper.Write(tarBytes(t, entries)); err == nil {
+		err = zipper.Close()
+	}
+	if err != nil {
+		t.Fatalf("tarball: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// writeTarball writes a gzipped tarball of entries to tarpath.
+func writeTarball(t *testing.T, tarpath string, entries []tarEntry) {
+	if err := ioutil.WriteFile(tarpath, tarballBytes(t, entries), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+// writeBinPkg writes a package file like the ones makepkg builds to pkgpath.
+// info is added to the .PKGINFO, which names the package pkgname and version.
+// The package contains files, which are paths without the leading slash.
+func writeBinPkg(t *testing.T, pkgpath, pkgname, version, info string, files ...string) {
+	pkginfo := fmt.Sprintf("pkgname = %s\npkgver = %s\n%s", pkgname, version, info)
+	mtree := bytes.NewBuffer(nil)
+	mtree.WriteString("#mtree\n/set type=file uid=0 gid=0 mode=644\n")
+	fmt.Fprintf(mtree, "./.PKGINFO size=%d\n", len(pkginfo))
+	for _, file := range files {
+		fmt.Fprintf(mtree, "./%s size=4\n", file)
+	}
+
+	zipped := bytes.NewBuffer(nil)
+	zipper, err := gzip.NewWriter(zipped)
+	if err != nil {
+		t.Fatalf("gzip: %s", err)
+	}
+	zipper.Write(mtree.Bytes())
+	zipper.Close()
+
+	entries := []tarEntry{{Name: ".PKGINFO", Body: pkginfo},
+		{Name: ".MTREE", Body: zipped.String()}}
+	for _, file := range files {
+		entries = append(entries, tarEntry{Name: file, Body: "data"})
+	}
+	writeTarball(t, pkgpath, entries)
+}
+
+// tempDir makes a temporary dir for a test, which the test must remove.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "maw-test-")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return dir
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// aurTest is a fake AUR serving source packages, and the dirs an AURCache
+// keeps them in.
+type aurTest struct {
+	dir     string
+	server  *httptest.Server
+	oldRoot string
+	srcpkgs map[string][]byte // by pkgname
+}
+
+func newAURTest(t *testing.T) *aurTest {
+	at := &aurTest{dir: tempDir(t), oldRoot: AUR_ROOT, srcpkgs: make(map[string][]byte)}
+	for _, dir := range []string{"src", "build", "pkgs"} {
+		if err := os.Mkdir(path.Join(at.dir, dir), 0755); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	at.server = httptest.NewServer(http.HandlerFunc(at.serve))
+	AUR_ROOT = at.server.URL
+	return at
+}
+
+func (at *aurTest) serve(w http.ResponseWriter, req *http.Request) {
+	pkgname := path.Base(path.Dir(req.URL.Path))
+	data, ok := at.srcpkgs[pkgname]
+	if !ok || req.URL.Path != "/packages/"+pkgname+"/"+pkgname+".tar.gz" {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write(data)
+}
+
+func (at *aurTest) close() {
+	at.server.Close()
+	AUR_ROOT = at.oldRoot
+	os.RemoveAll(at.dir)
+}
+
+// addSrcPkg puts a source package with the PKGBUILD pkgbuild on the fake AUR.
+func (at *aurTest) addSrcPkg(t *testing.T, pkgname, pkgbuild string) {
+	at.srcpkgs[pkgname] = tarballBytes(t, []tarEntry{
+		{Name: pkgname + "/", Typeflag: tar.TypeDir},
+		{Name: pkgname + "/PKGBUILD", Body: pkgbuild}})
+}
+
+// cache returns an AURCache for the fake AUR which builds with builder.
+func (at *aurTest) cache(builder Builder, policy SecurityPolicy) *AURCache {
+	return NewAURCache(path.Join(at.dir, "src"), path.Join(at.dir, "build"), builder, policy)
+}
+
+func (at *aurTest) pkgPath(filename string) string {
+	return path.Join(at.dir, "pkgs", filename)
+}
+
+const testPkgbuild = `pkgname=foo
+pkgver=1.0
+pkgrel=1
+arch=(x86_64)
+source=("https://example.com/$pkgname-$pkgver.tar.gz")
+sha256sums=('9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08')
+`
+
+func TestAURCacheFetch(t *testing.T) {
+	at := newAURTest(t)
+	defer at.close()
+	at.addSrcPkg(t, "foo", testPkgbuild)
+	pkgpath := at.pkgPath("foo-1.0-1-x86_64.pkg.tar.gz")
+	writeBinPkg(t, pkgpath, "foo", "1.0-1", "", "usr/bin/foo")
+
+	builder := &FakeBuilder{PkgPaths: []string{pkgpath}}
+	aur := at.cache(builder, PolicyRefuse)
+	pkgpaths, err := aur.Fetch(NewCanceler(), "foo")
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if len(pkgpaths) != 1 || pkgpaths[0] != pkgpath {
+		t.Errorf("fetched %v, want %s", pkgpaths, pkgpath)
+	}
+
+	built := builder.Built()
+	if len(built) != 1 || built[0] != path.Join(at.dir, "build", "foo") {
+		t.Errorf("built %v, want the extracted foo", built)
+	}
+	if _, err := os.Stat(path.Join(at.dir, "build", "foo", "PKGBUILD")); err != nil {
+		t.Errorf("PKGBUILD was not extracted: %s", err)
+	}
+	if _, err := os.Stat(path.Join(at.dir, "src", "foo.src.tar.gz")); err != nil {
+		t.Errorf("source package was not kept: %s", err)
+	}
+	if pkg := aur.BuiltPkg(pkgpath); pkg == nil || pkg.Name() != "foo" {
+		t.Errorf("BuiltPkg(%s) = %v, want foo", pkgpath, pkg)
+	}
+}
+
+func TestAURCacheNotFound(t *testing.T) {
+	at := newAURTest(t)
+	defer at.close()
+
+	builder := &FakeBuilder{}
+	_, err := at.cache(builder, PolicyWarn).Fetch(NewCanceler(), "nosuchpkg")
+	if err == nil || !err.NotFound() {
+		t.Errorf("Fetch of a missing package returned %v, want not found", err)
+	}
+	if len(builder.Built()) != 0 {
+		t.Errorf("something was built")
+	}
+}
+
+func TestAURCacheBuildFails(t *testing.T) {
+	at := newAURTest(t)
+	defer at.close()
+	at.addSrcPkg(t, "foo", testPkgbuild)
+
+	builder := &FakeBuilder{Error: os.NewError("makepkg failed")}
+	_, err := at.cache(builder, PolicyWarn).Fetch(NewCanceler(), "foo")
+	if err == nil || err.NotFound() {
+		t.Errorf("Fetch with a failed build returned %v, want the build error", err)
+	}
+}
+
+func TestAURCacheRefusesInsecure(t *testing.T) {
+	at := newAURTest(t)
+	defer at.close()
+	at.addSrcPkg(t, "foo", `pkgname=foo
+pkgver=1.0
+pkgrel=1
+source=("http://example.com/foo.tar.gz")
+sha256sums=('SKIP')
+`)
+
+	builder := &FakeBuilder{}
+	if _, err := at.cache(builder, PolicyRefuse).Fetch(NewCanceler(), "foo"); err == nil {
+		t.Errorf("Fetch of an insecure package succeeded with PolicyRefuse")
+	}
+	if len(builder.Built()) != 0 {
+		t.Errorf("the insecure package was built")
+	}
+}
+
+func TestAURCacheWrongPackage(t *testing.T) {
+	at := newAURTest(t)
+	defer at.close()
+	at.addSrcPkg(t, "foo", testPkgbuild)
+
+	// The file is named foo, but contains bar.
+	pkgpath := at.pkgPath("foo-1.0-1-x86_64.pkg.tar.gz")
+	writeBinPkg(t, pkgpath, "bar", "1.0-1", "", "usr/bin/bar")
+	builder := &FakeBuilder{PkgPaths: []string{pkgpath}}
+	if _, err := at.cache(builder, PolicyWarn).Fetch(NewCanceler(), "foo"); err == nil {
+		t.Errorf("Fetch accepted a package that isn't what its filename says")
+	}
+}
+
+func TestAURCacheDebugPackage(t *testing.T) {
+	at := newAURTest(t)
+	defer at.close()
+	at.addSrcPkg(t, "foo", testPkgbuild)
+
+	pkgpaths := []string{at.pkgPath("foo-1.0-1-x86_64.pkg.tar.gz"),
+		at.pkgPath("foo-debug-1.0-1-x86_64.pkg.tar.gz")}
+	writeBinPkg(t, pkgpaths[0], "foo", "1.0-1", "", "usr/bin/foo")
+	writeBinPkg(t, pkgpaths[1], "foo-debug", "1.0-1", "", "usr/lib/debug/usr/bin/foo.debug")
+	builder := &FakeBuilder{PkgPaths: pkgpaths}
+	if _, err := at.cache(builder, PolicyWarn).Fetch(NewCanceler(), "foo"); err != nil {
+		t.Errorf("Fetch with a -debug package: %s", err)
+	}
+}
+
+func TestMadeByPkgbuild(t *testing.T) {
+	tests := []struct {
+		pkgbuild, pkgname string
+		made, unsure      bool
+	}{
+		{"pkgname=foo", "foo", true, false},
+		{"pkgname=foo", "bar", false, false},
+		{"pkgname=foo", "foo-debug", true, false},
+		{"pkgname=(foo foo-docs)", "foo-docs", true, false},
+		{"pkgname=(foo foo-docs)", "foo-docs-debug", false, false},
+		{"pkgbase=foo-git\npkgname=(foo foo-docs)", "foo-git-debug", true, false},
+		{"pkgbase=foo-git\npkgname=(foo foo-docs)", "foo-debug", false, false},
+		{"pkgbase=foo-git\npkgname=(foo foo-docs)", "foo-git", false, false},
+		{"pkgname=foo-debug", "foo-debug", true, false},
+		{"pkgname=($_flavor-{a,b})", "foo-a", false, true},
+		{"pkgbase=$(echo foo)\npkgname=bar", "foo-debug", false, true},
+		{"pkgver=1.0", "foo", false, true},
+	}
+	for _, test := range tests {
+		made, unsure := madeByPkgbuild(parsePkgbuild(test.pkgbuild), test.pkgname)
+		if made != test.made || unsure != test.unsure {
+			t.Errorf("%q makes %s: got %v, unsure %v", test.pkgbuild, test.pkgname, made, unsure)
+		}
+	}
+}
+
+// Everything under a dir given away is chowned, however deep, but symlinks
+// aren't followed out of it.
+func TestGiveFiles(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Logf("can't chown without root, skipped")
+		return
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeCacheFiles(t, dir, map[string]string{
+		"outside":                 "not ours",
+		"build/foo/PKGBUILD":      "pkgname=foo\n",
+		"build/foo/src/a/b/c/d.c": "int main;",
+		"build/foo/src/empty/":    "",
+		"src/foo.src.tar.gz":      "foo source",
+	})
+	if err := os.Symlink("../../../outside", path.Join(dir, "build/foo/src/link")); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	owner := &BuildUser{Name: "maw-test", Uid: 54321, Gid: 54322}
+	aur := &AURCache{owner: owner}
+	err := aur.giveFiles(path.Join(dir, "build/foo"), path.Join(dir, "src/foo.src.tar.gz"))
+	if err != nil {
+		t.Fatalf("giveFiles: %s", err)
+	}
+	for _, name := range []string{"build/foo", "build/foo/PKGBUILD", "build/foo/src",
+		"build/foo/src/a/b/c", "build/foo/src/a/b/c/d.c", "build/foo/src/empty",
+		"build/foo/src/link", "src/foo.src.tar.gz"} {
+		stat, err := os.Lstat(path.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if stat.Uid != owner.Uid || stat.Gid != owner.Gid {
+			t.Errorf("%s is owned by %d:%d", name, stat.Uid, stat.Gid)
+		}
+	}
+	for _, name := range []string{"outside", "build"} {
+		if stat, _ := os.Lstat(path.Join(dir, name)); stat.Uid != 0 {
+			t.Errorf("%s was given away too", name)
+		}
+	}
+}
+
+func TestGiveFilesFailed(t *testing.T) {
+	owner := &BuildUser{Name: "maw-test", Uid: os.Getuid(), Gid: os.Getgid()}
+	aur := &AURCache{owner: owner}
+	err := aur.giveFiles("/nonexistent/maw-test")
+	if err == nil || !strings.Contains(err.String(), "failed to give /nonexistent/maw-test to maw-test") {
+		t.Errorf("giveFiles returned %v", err)
+	}
+
+	// Without an owner, the files stay ours.
+	aur = &AURCache{}
+	if err := aur.giveFiles("/nonexistent/maw-test"); err != nil {
+		t.Errorf("giveFiles without an owner returned %s", err)
+	}
+}
@@ -0,0 +1,285 @@
+/*	cache.go
+	Listing and pruning the files maw leaves lying around: downloaded source
+	packages, build directories and the packages built inside them.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+	"strings"
+	"io/ioutil"
+)
+
+const (
+	CacheSource  = "source"
+	CacheBuild   = "build"
+	CachePackage = "package"
+)
+
+// CacheEntry is one thing in the cache: a source package file, a build
+// directory or a built package file.
+type CacheEntry struct {
+	Kind     string
+	Path     string
+	PkgName  string   // the pkgbase of source packages and build dirs
+	PkgNames []string // the packages built from a pkgbase, from its .SRCINFO
+	Version  string   // only known for built packages
+	Size     int64    // for build dirs, the size of everything but built packages
+	Mtime    int64    // in seconds
+}
+
+// isInstalled returns true if the entry belongs to a package in installed,
+// which maps package names to their versions. Built packages must be the
+// installed version; for the others any package built from them will do.
+func (entry *CacheEntry) isInstalled(installed map[string]string) bool {
+	if entry.Kind == CachePackage {
+		instver, ok := installed[entry.PkgName]
+		return ok && instver == entry.Version
+	}
+	for _, pkgname := range entry.PkgNames {
+		if _, ok := installed[pkgname]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CachePrune says which cache entries to remove. An entry is removed if it
+// matches any of the criteria that are set.
+type CachePrune struct {
+	MaxAge      int64 // in seconds, 0 for no limit
+	Uninstalled bool  // remove entries for packages that are not installed
+	Keep        int   // keep only this many of the newest built packages per name, 0 for all
+}
+
+// IsSet returns true if any criteria are set, i.e. something may get pruned.
+func (prune *CachePrune) IsSet() bool {
+	return prune.MaxAge > 0 || prune.Uninstalled || prune.Keep > 0
+}
+
+// isPkgFile returns true if filename looks like a binary package file.
+func isPkgFile(filename string) bool {
+	return strings.Contains(filename, ".pkg.tar")
+}
+
+// parsePkgFilename splits a package filename like foo-1.0-1-x86_64.pkg.tar.xz
+// into its name and full version (1.0-1). Returns empty strings if the
+// filename is not of that form.
+func parsePkgFilename(filename string) (pkgname, version string) {
+	idx := strings.Index(filename, ".pkg.tar")
+	if idx == -1 {
+		return "", ""
+	}
+	base := filename[:idx]
+
+	// Strip off the architecture, what is left is named like a DB entry.
+	idx = strings.LastIndex(base, "-")
+	if idx == -1 {
+		return "", ""
+	}
+	base = base[:idx]
+	pkgname = entryPkgName(base)
+	if pkgname == "" {
+		return "", ""
+	}
+	return pkgname, base[len(pkgname)+1:]
+}
+
+// dirSize returns the size of all files under dirpath, skipping package files.
+// Symlinks are not followed.
+func dirSize(dirpath string) int64 {
+	infos, err := ioutil.ReadDir(dirpath)
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, info := range infos {
+		switch {
+		case info.IsDirectory():
+			size += dirSize(path.Join(dirpath, info.Name))
+		case info.IsRegular() && !isPkgFile(info.Name):
+			size += info.Size
+		}
+	}
+	return size
+}
+
+// readCacheDir reads the dir like ioutil.ReadDir does, except that a dir that
+// doesn't exist is empty. Nothing has been cached in it yet.
+func readCacheDir(dirpath string) ([]*os.FileInfo, os.Error) {
+	infos, err := ioutil.ReadDir(dirpath)
+	if perr, ok := err.(*os.PathError); ok && perr.Error == os.ENOENT {
+		return nil, nil
+	}
+	return infos, err
+}
+
+// CacheEntries lists everything in the AURCache's source package dir and build
+// root. Build dirs are recognized by the PKGBUILD inside them. The pkgnames of
+// a pkgbase are read from its build dir; if it has none, the pkgbase is taken
+// to be the only pkgname.
+func (aur *AURCache) CacheEntries() ([]*CacheEntry, os.Error) {
+	entries := make([]*CacheEntry, 0, 64)
+	pkgnames := make(map[string][]string)
+
+	infos, err := readCacheDir(aur.buildroot)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		builddir := path.Join(aur.buildroot, info.Name)
+		if !info.IsDirectory() {
+			continue
+		}
+		if _, err := os.Stat(path.Join(builddir, "PKGBUILD")); err != nil {
+			continue
+		}
+		names := []string{info.Name}
+		if vars, err := ReadPkgbuildVars(builddir); err == nil && len(vars["pkgname"]) > 0 {
+			names = vars["pkgname"]
+		}
+		pkgnames[info.Name] = names
+		entries = append(entries, &CacheEntry{CacheBuild, builddir, info.Name,
+			names, "", dirSize(builddir), info.Mtime_ns / 1000000000})
+
+		// Unless PKGDEST is set, makepkg leaves built packages in the build dir.
+		pkginfos, err := ioutil.ReadDir(builddir)
+		if err != nil {
+			continue
+		}
+		for _, pkginfo := range pkginfos {
+			pkgname, version := parsePkgFilename(pkginfo.Name)
+			if !pkginfo.IsRegular() || pkgname == "" {
+				continue
+			}
+			entries = append(entries, &CacheEntry{CachePackage,
+				path.Join(builddir, pkginfo.Name), pkgname, []string{pkgname},
+				version, pkginfo.Size, pkginfo.Mtime_ns / 1000000000})
+		}
+	}
+
+	infos, err = readCacheDir(aur.srcpkgdest)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !info.IsRegular() || !strings.HasSuffix(info.Name, ".src.tar.gz") {
+			continue
+		}
+		pkgbase := info.Name[:len(info.Name)-len(".src.tar.gz")]
+		names, ok := pkgnames[pkgbase]
+		if !ok {
+			names = []string{pkgbase}
+		}
+		entries = append(entries, &CacheEntry{CacheSource,
+			path.Join(aur.srcpkgdest, info.Name), pkgbase, names, "",
+			info.Size, info.Mtime_ns / 1000000000})
+	}
+
+	return entries, nil
+}
+
+// newestFirst sorts built package entries by modification time, newest first.
+type newestFirst []*CacheEntry
+
+func (entries newestFirst) Len() int           { return len(entries) }
+func (entries newestFirst) Less(i, j int) bool { return entries[i].Mtime > entries[j].Mtime }
+func (entries newestFirst) Swap(i, j int)      { entries[i], entries[j] = entries[j], entries[i] }
+
+// SelectPrunable returns the entries that should be removed according to
+// prune. installed maps installed package names to their versions.
+func SelectPrunable(entries []*CacheEntry, prune *CachePrune, installed map[string]string) []*CacheEntry {
+	doomed := make(map[*CacheEntry]bool)
+	now := time.Seconds()
+
+	pkgsByName := make(map[string][]*CacheEntry)
+	for _, entry := range entries {
+		if prune.MaxAge > 0 && now-entry.Mtime > prune.MaxAge {
+			doomed[entry] = true
+		}
+		if prune.Uninstalled && !entry.isInstalled(installed) {
+			doomed[entry] = true
+		}
+		if entry.Kind == CachePackage {
+			pkgsByName[entry.PkgName] = append(pkgsByName[entry.PkgName], entry)
+		}
+	}
+
+	if prune.Keep > 0 {
+		for _, pkgs := range pkgsByName {
+			sort.Sort(newestFirst(pkgs))
+			for i := prune.Keep; i < len(pkgs); i++ {
+				doomed[pkgs[i]] = true
+			}
+		}
+	}
+
+	// Keep the same order as entries.
+	prunable := make([]*CacheEntry, 0, len(doomed))
+	for _, entry := range entries {
+		if doomed[entry] {
+			prunable = append(prunable, entry)
+		}
+	}
+	return prunable
+}
+
+// humanSize formats a size in bytes for people.
+func humanSize(size int64) string {
+	units := []string{"B", "K", "M", "G"}
+	fsize := float64(size)
+	unit := 0
+	for fsize >= 1024 && unit < len(units)-1 {
+		fsize /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f%s", fsize, units[unit])
+}
+
+func printCacheEntry(entry *CacheEntry) {
+	fmt.Printf("%-8s %-30s %8s  %s\n", entry.Kind, entry.PkgName,
+		humanSize(entry.Size), entry.Path)
+}
+
+// CleanCache lists the AURCache's cache entries. If prune has any criteria
+// set, the matching entries are removed instead. Removing a build dir also
+// removes any packages that were built inside it.
+func (aur *AURCache) CleanCache(prune *CachePrune, installed map[string]string) os.Error {
+	entries, err := aur.CacheEntries()
+	if err != nil {
+		return err
+	}
+
+	if !prune.IsSet() {
+		var total int64
+		for _, entry := range entries {
+			printCacheEntry(entry)
+			total += entry.Size
+		}
+		fmt.Printf("%d cache entries, %s total\n", len(entries), humanSize(total))
+		return nil
+	}
+
+	var freed int64
+	removed := 0
+	for _, entry := range SelectPrunable(entries, prune, installed) {
+		if err := os.RemoveAll(entry.Path); err != nil {
+			fmt.Printf("error: failed to remove %s: %s\n", entry.Path, err.String())
+			continue
+		}
+		fmt.Printf("removed %s %s\n", entry.Kind, entry.Path)
+		freed += entry.Size
+		removed++
+	}
+	fmt.Printf("%d cache entries removed, %s freed\n", removed, humanSize(freed))
+	return nil
+}
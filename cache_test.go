@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path"
+	"time"
+	"strings"
+	"testing"
+	"io/ioutil"
+)
+
+func TestCacheRoot(t *testing.T) {
+	tests := []struct {
+		user *BuildUser
+		want string
+	}{
+		{&BuildUser{Name: DefaultBuildUser, Home: DefaultBuildHome}, DefaultBuildHome},
+		{&BuildUser{Name: DefaultBuildUser, Home: "/home/maw"}, "/home/maw/.cache/maw"},
+		{&BuildUser{Name: "alice", Home: "/home/alice"}, "/home/alice/.cache/maw"},
+		{&BuildUser{Name: "builder", Home: "/srv/builder"}, "/srv/builder/.cache/maw"},
+	}
+	for _, test := range tests {
+		if root := test.user.CacheRoot(); root != test.want {
+			t.Errorf("%s with home %s: CacheRoot = %s, want %s", test.user.Name,
+				test.user.Home, root, test.want)
+		}
+	}
+
+	old := os.Getenv("XDG_CACHE_HOME")
+	defer os.Setenv("XDG_CACHE_HOME", old)
+	os.Setenv("XDG_CACHE_HOME", "/tmp/maw-test-cache")
+	var user *BuildUser
+	if root := user.CacheRoot(); root != "/tmp/maw-test-cache/maw" {
+		t.Errorf("our CacheRoot = %s, want /tmp/maw-test-cache/maw", root)
+	}
+}
+
+// writeCacheFiles creates the files named in dir, with the contents given.
+// Names ending in "/" are dirs.
+func writeCacheFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		filepath := path.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(filepath, 0755); err != nil {
+				t.Fatalf("%s", err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(path.Dir(filepath), 0755); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if err := ioutil.WriteFile(filepath, []byte(data), 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeCacheFiles(t, dir, map[string]string{
+		"build/foo/PKGBUILD":                       "pkgbase=foo\npkgname=(foo foo-docs)\n",
+		"build/foo/foo-1.0-1-x86_64.pkg.tar.zst":   "foo package",
+		"build/foo/foo-docs-1.0-1-any.pkg.tar.zst": "docs",
+		"build/foo/src/foo.c":                      "int main;",
+		"build/bar/PKGBUILD":                       "pkgname=bar\n",
+		"build/notapkg/":                           "",
+		"build/stray.pkg.tar.zst":                  "",
+		"src/foo.src.tar.gz":                       "foo source",
+		"src/baz.src.tar.gz":                       "baz source",
+		"src/README":                               "",
+	})
+	aur := NewAURCache(path.Join(dir, "src"), path.Join(dir, "build"), nil, nil)
+
+	entries, err := aur.CacheEntries()
+	if err != nil {
+		t.Fatalf("CacheEntries: %s", err)
+	}
+	want := map[string]string{
+		"build/bar":                              "build bar bar",
+		"build/foo":                              "build foo foo|foo-docs",
+		"build/foo/foo-1.0-1-x86_64.pkg.tar.zst": "package foo-1.0-1 foo",
+		"build/foo/foo-docs-1.0-1-any.pkg.tar.zst": "package foo-docs-1.0-1 foo-docs",
+		"src/foo.src.tar.gz":                       "source foo foo|foo-docs",
+		"src/baz.src.tar.gz":                       "source baz baz",
+	}
+	for _, entry := range entries {
+		relpath := entry.Path[len(dir)+1:]
+		name := entry.PkgName
+		if entry.Version != "" {
+			name += "-" + entry.Version
+		}
+		got := entry.Kind + " " + name + " " + strings.Join(entry.PkgNames, "|")
+		if want[relpath] != got {
+			t.Errorf("%s: got %q, want %q", relpath, got, want[relpath])
+		}
+		want[relpath] = "", false
+	}
+	for relpath := range want {
+		t.Errorf("%s is missing", relpath)
+	}
+
+	// The build dir's size doesn't count the packages built in it.
+	for _, entry := range entries {
+		if entry.Kind == CacheBuild && entry.PkgName == "foo" &&
+			entry.Size != int64(len("pkgbase=foo\npkgname=(foo foo-docs)\n")+len("int main;")) {
+			t.Errorf("build dir foo has size %d", entry.Size)
+		}
+	}
+}
+
+// The cache entries SelectPrunable is tested with. Some days ago foo 1.0 was
+// built, then foo 1.1, then today foo 1.2, which is installed. bar isn't.
+func pruneTestEntries() []*CacheEntry {
+	now := time.Seconds()
+	day := int64(24 * 60 * 60)
+	return []*CacheEntry{
+		{CacheSource, "src/foo.src.tar.gz", "foo", []string{"foo", "foo-docs"}, "", 1, now - 10*day},
+		{CacheBuild, "build/foo", "foo", []string{"foo", "foo-docs"}, "", 1, now},
+		{CachePackage, "build/foo/foo-1.0-1", "foo", []string{"foo"}, "1.0-1", 1, now - 10*day},
+		{CachePackage, "build/foo/foo-1.1-1", "foo", []string{"foo"}, "1.1-1", 1, now - 5*day},
+		{CachePackage, "build/foo/foo-1.2-1", "foo", []string{"foo"}, "1.2-1", 1, now},
+		{CachePackage, "build/foo/foo-docs-1.2-1", "foo-docs", []string{"foo-docs"}, "1.2-1", 1, now - 10*day},
+		{CacheSource, "src/bar.src.tar.gz", "bar", []string{"bar"}, "", 1, now - 2*day},
+		{CacheBuild, "build/bar", "bar", []string{"bar"}, "", 1, now - 2*day},
+	}
+}
+
+func TestSelectPrunable(t *testing.T) {
+	day := int64(24 * 60 * 60)
+	installed := map[string]string{"foo": "1.2-1"}
+	tests := []struct {
+		name  string
+		prune CachePrune
+		want  string
+	}{
+		{"nothing", CachePrune{}, ""},
+		{"max age", CachePrune{MaxAge: 7 * day},
+			"src/foo.src.tar.gz build/foo/foo-1.0-1 build/foo/foo-docs-1.2-1"},
+		{"uninstalled", CachePrune{Uninstalled: true},
+			"build/foo/foo-1.0-1 build/foo/foo-1.1-1 build/foo/foo-docs-1.2-1 " +
+				"src/bar.src.tar.gz build/bar"},
+		{"keep", CachePrune{Keep: 1}, "build/foo/foo-1.0-1 build/foo/foo-1.1-1"},
+		{"keep more than there are", CachePrune{Keep: 5}, ""},
+		{"any of them", CachePrune{MaxAge: 3 * day, Keep: 2},
+			"src/foo.src.tar.gz build/foo/foo-1.0-1 build/foo/foo-1.1-1 build/foo/foo-docs-1.2-1"},
+	}
+	for _, test := range tests {
+		prunable := SelectPrunable(pruneTestEntries(), &test.prune, installed)
+		paths := make([]string, len(prunable))
+		for i, entry := range prunable {
+			paths[i] = entry.Path
+		}
+		if got := strings.Join(paths, " "); got != test.want {
+			t.Errorf("%s: pruned %q, want %q", test.name, got, test.want)
+		}
+	}
+}
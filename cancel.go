@@ -0,0 +1,187 @@
+/*	cancel.go
+	Cancellation of fetches and builds when we are interrupted by a signal.
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"sync"
+	"syscall"
+	"os/signal"
+)
+
+var (
+	ErrCanceled = os.NewError("interrupted")
+)
+
+// A Canceler keeps track of everything that must be undone if maw is
+// interrupted: child processes (makepkg, pacman) that must be killed, network
+// connections that must be closed so that blocked downloads return, and
+// partially written files that must be removed.
+//
+// A single Canceler is shared by every fetcher and builder and is safe to use
+// from many goroutines at once.
+type Canceler struct {
+	lock     sync.Mutex
+	canceled bool
+	signum   int
+	procs    map[*os.Process]bool
+	closers  map[io.Closer]bool
+	partials map[string]bool
+}
+
+func NewCanceler() *Canceler {
+	return &Canceler{procs: make(map[*os.Process]bool),
+		closers:  make(map[io.Closer]bool),
+		partials: make(map[string]bool)}
+}
+
+// HandleSignals cancels everything when SIGINT, SIGTERM or SIGHUP is received.
+// Meant to be run as its own goroutine. A second signal exits immediately,
+// after removing partial files.
+func (cn *Canceler) HandleSignals() {
+	for sig := range signal.Incoming {
+		usig, ok := sig.(os.UnixSignal)
+		if !ok {
+			continue
+		}
+		switch usig {
+		case os.SIGINT, os.SIGTERM, os.SIGHUP:
+			// handled below
+		default:
+			continue
+		}
+
+		if cn.Canceled() {
+			cn.Cleanup()
+			os.Exit(cn.ExitStatus())
+		}
+		fmt.Fprintf(os.Stderr, "\ninterrupted by %s, cleaning up...\n", usig.String())
+		cn.Cancel(int(usig))
+	}
+}
+
+// Cancel marks the Canceler as canceled, kills all registered child
+// processes and closes all registered connections. signum is the signal
+// that caused us to cancel, or 0.
+func (cn *Canceler) Cancel(signum int) {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+
+	if cn.canceled {
+		return
+	}
+	cn.canceled = true
+	cn.signum = signum
+
+	for proc, _ := range cn.procs {
+		terminate(proc)
+	}
+	for closer, _ := range cn.closers {
+		closer.Close()
+	}
+}
+
+// Cleanup removes any partial files that are still registered. This should
+// be called once all fetchers have returned.
+func (cn *Canceler) Cleanup() {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+
+	for path, _ := range cn.partials {
+		os.Remove(path)
+		cn.partials[path] = false, false
+	}
+}
+
+func (cn *Canceler) Canceled() bool {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	return cn.canceled
+}
+
+// ExitStatus returns the exit status maw should use after being canceled,
+// following the shell convention of 128 plus the signal number.
+func (cn *Canceler) ExitStatus() int {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	if cn.signum == 0 {
+		return 1
+	}
+	return 128 + cn.signum
+}
+
+// AddProcess registers a child process to be killed on cancel. If we have
+// already been canceled the process is killed right away and ErrCanceled is
+// returned.
+func (cn *Canceler) AddProcess(proc *os.Process) os.Error {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+
+	if cn.canceled {
+		terminate(proc)
+		return ErrCanceled
+	}
+	cn.procs[proc] = true
+	return nil
+}
+
+// terminate sends SIGTERM to proc, which gives makepkg the chance to clean up
+// after itself. pacman run through sudo, doas or pkexec may run as root, and
+// then we aren't allowed to signal it. If a ^C interrupted us, the terminal sent it SIGINT
+// along with us; otherwise it is left to finish, and waited for.
+func terminate(proc *os.Process) {
+	if errno := syscall.Kill(proc.Pid, syscall.SIGTERM); errno == syscall.EPERM {
+		fmt.Fprintf(os.Stderr, "warning: can't stop process %d, which runs as root; "+
+			"waiting for it to finish\n", proc.Pid)
+	}
+}
+
+func (cn *Canceler) RemoveProcess(proc *os.Process) {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	cn.procs[proc] = false, false
+}
+
+// AddCloser registers a connection (or anything else) to be closed on cancel.
+// If we have already been canceled, the closer is closed right away and
+// ErrCanceled is returned.
+func (cn *Canceler) AddCloser(closer io.Closer) os.Error {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+
+	if cn.canceled {
+		closer.Close()
+		return ErrCanceled
+	}
+	cn.closers[closer] = true
+	return nil
+}
+
+func (cn *Canceler) RemoveCloser(closer io.Closer) {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	cn.closers[closer] = false, false
+}
+
+// AddPartial registers a file that is being written to. It will be removed by
+// Cleanup unless RemovePartial is called first, once the file is complete.
+func (cn *Canceler) AddPartial(path string) os.Error {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+
+	if cn.canceled {
+		return ErrCanceled
+	}
+	cn.partials[path] = true
+	return nil
+}
+
+func (cn *Canceler) RemovePartial(path string) {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	cn.partials[path] = false, false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path"
+	"time"
+	"strings"
+	"testing"
+	"io/ioutil"
+)
+
+// testCloser records whether it was closed.
+type testCloser struct {
+	closed bool
+}
+
+func (closer *testCloser) Close() os.Error {
+	closer.closed = true
+	return nil
+}
+
+func TestCancel(t *testing.T) {
+	cn := NewCanceler()
+	closer, kept := &testCloser{}, &testCloser{}
+	if err := cn.AddCloser(closer); err != nil {
+		t.Fatalf("AddCloser: %s", err)
+	}
+	cn.AddCloser(kept)
+	cn.RemoveCloser(kept)
+
+	cn.Cancel(2)
+	cn.Cancel(15)
+	if !cn.Canceled() {
+		t.Errorf("not canceled")
+	}
+	if status := cn.ExitStatus(); status != 130 {
+		t.Errorf("ExitStatus = %d, want 130 for the first signal", status)
+	}
+	if !closer.closed || kept.closed {
+		t.Errorf("closed %v and removed closer %v, want only the first", closer.closed,
+			kept.closed)
+	}
+
+	// Anything added later is undone right away.
+	late := &testCloser{}
+	if err := cn.AddCloser(late); err != ErrCanceled || !late.closed {
+		t.Errorf("AddCloser after Cancel returned %v and closed %v", err, late.closed)
+	}
+	if err := cn.AddPartial("/tmp/maw-test-late"); err != ErrCanceled {
+		t.Errorf("AddPartial after Cancel returned %v", err)
+	}
+}
+
+func TestCancelExitStatus(t *testing.T) {
+	cn := NewCanceler()
+	cn.Cancel(0)
+	if status := cn.ExitStatus(); status != 1 {
+		t.Errorf("ExitStatus without a signal = %d, want 1", status)
+	}
+}
+
+// Cleanup removes the partial files still registered, and only those.
+func TestCancelCleanup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeCacheFiles(t, dir, map[string]string{"partial": "half", "done": "all"})
+
+	cn := NewCanceler()
+	cn.AddPartial(path.Join(dir, "partial"))
+	cn.AddPartial(path.Join(dir, "done"))
+	cn.RemovePartial(path.Join(dir, "done"))
+	cn.Cancel(2)
+	cn.Cleanup()
+	if names := dirNames(t, dir); len(names) != 1 || names[0] != "done" {
+		t.Errorf("left %v, want only the complete file", names)
+	}
+}
+
+// A command that is running when we are interrupted is stopped.
+func TestCancelKillsProcess(t *testing.T) {
+	cn := NewCanceler()
+	errs := make(chan os.Error, 1)
+	go func() {
+		_, err := NewExecRunner(nil).Run(cn, &Command{Name: "/bin/sleep", Args: []string{"30"}})
+		errs <- err
+	}()
+	for started := false; !started; {
+		time.Sleep(10e6)
+		cn.lock.Lock()
+		started = len(cn.procs) > 0
+		cn.lock.Unlock()
+	}
+
+	cn.Cancel(15)
+	select {
+	case err := <-errs:
+		if err != ErrCanceled {
+			t.Errorf("Run returned %v, want ErrCanceled", err)
+		}
+	case <-time.After(10e9):
+		t.Fatalf("sleep wasn't stopped")
+	}
+}
+
+// cancelingReader reads n bytes of data, then cancels cn and fails like a
+// closed connection would.
+type cancelingReader struct {
+	cn *Canceler
+	n  int
+}
+
+func (rdr *cancelingReader) Read(buf []byte) (int, os.Error) {
+	if rdr.n == 0 {
+		rdr.cn.Cancel(2)
+		return 0, os.NewError("use of closed network connection")
+	}
+	if len(buf) > rdr.n {
+		buf = buf[:rdr.n]
+	}
+	copy(buf, strings.Repeat("x", len(buf)))
+	rdr.n -= len(buf)
+	return len(buf), nil
+}
+
+// An interrupted download leaves neither the file nor its partial download
+// behind.
+func TestSaveDownloadCanceled(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	destpath := path.Join(dir, "foo.src.tar.gz")
+
+	cn := NewCanceler()
+	_, err := saveDownload(cn, destpath, &cancelingReader{cn, 100}, 200)
+	if err != ErrCanceled {
+		t.Errorf("saveDownload returned %v, want ErrCanceled", err)
+	}
+	if names := dirNames(t, dir); len(names) != 0 {
+		t.Errorf("left %v", names)
+	}
+}
+
+// An interrupted download of a repo package is kept to be resumed, unlike
+// those from the AUR.
+func TestResumeDownloadCanceled(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	destpath := path.Join(dir, testPkgFilename)
+
+	partial, err := lockPartial(destpath)
+	if err != nil {
+		t.Fatalf("lockPartial: %s", err)
+	}
+	cn := NewCanceler()
+	_, err = resumeDownload(cn, partial, destpath, &cancelingReader{cn, 100}, 0, 200, nil)
+	closePartial(partial)
+	if err != ErrCanceled {
+		t.Errorf("resumeDownload returned %v, want ErrCanceled", err)
+	}
+	if data, _ := ioutil.ReadFile(partialPath(destpath)); len(data) != 100 {
+		t.Errorf("kept %d bytes, want the 100 downloaded", len(data))
+	}
+	if _, err := os.Stat(destpath); err == nil {
+		t.Errorf("the incomplete download was saved")
+	}
+}
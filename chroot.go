@@ -0,0 +1,211 @@
+/*	chroot.go
+	Building packages inside a clean chroot, like devtools' makechrootpkg.
+	A base root with base-devel installed is bootstrapped once. Every build
+	gets a fresh copy of it, so that neither the host's installed packages
+	nor the previous build's makedepends can leak into the package.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"sync"
+	"strings"
+	"io/ioutil"
+)
+
+const (
+	ChrootBuildUser = "mawbuild"
+	chrootMarker    = ".maw-chroot" // created once the base root is complete
+)
+
+// The host's files that are copied into the chroot. Variables for testing.
+var (
+	hostMirrorlist = "/etc/pacman.d/mirrorlist"
+	hostResolvConf = "/etc/resolv.conf"
+)
+
+// The build runs inside new mount and PID namespaces. The bind mounts made
+// for the build vanish with the namespace, so nothing is left mounted on the
+// host, even if the build is killed. $1 is the root of the build copy, $2 the
+// host's package cache dir.
+const chrootRunnerScript = `
+set -e
+mount --make-rprivate /
+mount -t proc proc "$1/proc"
+mount --rbind /dev "$1/dev"
+mount --rbind /sys "$1/sys"
+mount --bind "$2" "$1/var/cache/pacman/pkg"
+exec chroot "$1" /bin/sh -c 'cd /build && exec su ` + ChrootBuildUser +
+	` -c "PKGDEST=/pkgdest makepkg -s -f -L --noconfirm"'
+`
+
+// ChrootBuilder builds packages inside copies of a clean root kept in dir.
+type ChrootBuilder struct {
+	dir      string
+	cachedir string     // the host's package cache, shared with the chroot
+	lock     sync.Mutex // held while the base root is bootstrapped
+	ready    bool       // if the base root is bootstrapped and up to date
+}
+
+func NewChrootBuilder(dir, cachedir string) *ChrootBuilder {
+	return &ChrootBuilder{dir: dir, cachedir: cachedir}
+}
+
+func (cb *ChrootBuilder) rootPath() string {
+	return path.Join(cb.dir, "root")
+}
+
+// Bootstrap creates the base root, or upgrades it if it already exists, so
+// that its sync DBs are fresh for installing makedepends. Builds run
+// concurrently and all call Bootstrap, but only the first call does anything
+// unless it fails.
+func (cb *ChrootBuilder) Bootstrap(cn *Canceler) os.Error {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.ready {
+		return nil
+	}
+
+	var err os.Error
+	if _, err = os.Stat(path.Join(cb.rootPath(), chrootMarker)); err == nil {
+		err = cb.update(cn)
+	} else {
+		err = cb.create(cn)
+	}
+	cb.ready = err == nil
+	return err
+}
+
+// update upgrades the base root with the host's mirrors. Only refreshing the
+// sync DBs would make makedepends installed later a partial upgrade.
+func (cb *ChrootBuilder) update(cn *Canceler) os.Error {
+	root := cb.rootPath()
+	fmt.Printf(":: Updating clean chroot in %s\n", root)
+	if err := copyFile(hostMirrorlist, path.Join(root, "etc/pacman.d/mirrorlist")); err != nil {
+		return err
+	}
+	return runCommand(cn, "", "pacman", "--root", root, "--cachedir", cb.cachedir,
+		"--noconfirm", "-Syu")
+}
+
+// create creates the base root. base-devel is installed into it with the
+// host's pacman, and a build user is created with permission to install
+// makedepends through sudo.
+func (cb *ChrootBuilder) create(cn *Canceler) os.Error {
+	root := cb.rootPath()
+	fmt.Printf(":: Creating clean chroot in %s\n", root)
+	if err := os.MkdirAll(path.Join(root, "var/lib/pacman"), 0755); err != nil {
+		return err
+	}
+	err := runCommand(cn, "", "pacman", "--root", root, "--cachedir", cb.cachedir,
+		"--noconfirm", "-Sy", "base-devel")
+	if err != nil {
+		return err
+	}
+
+	// Use the same mirrors as the host.
+	if err := copyFile(hostMirrorlist, path.Join(root, "etc/pacman.d/mirrorlist")); err != nil {
+		return err
+	}
+
+	err = runCommand(cn, "", "chroot", root, "useradd", "-m", ChrootBuildUser)
+	if err != nil {
+		return err
+	}
+	sudoers := ChrootBuildUser + " ALL = NOPASSWD: /usr/bin/pacman\n"
+	err = ioutil.WriteFile(path.Join(root, "etc/sudoers.d", ChrootBuildUser),
+		[]byte(sudoers), 0440)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(root, chrootMarker), nil, 0644)
+}
+
+// Build builds the package in srcdir inside a fresh copy of the base root.
+// The built packages and build logs are moved into srcdir, so the result is
+// just like PackageBuilder's.
+func (cb *ChrootBuilder) Build(cn *Canceler, srcdir string) (*BuildResult, os.Error) {
+	if err := cb.Bootstrap(cn); err != nil {
+		return nil, err
+	}
+
+	copydir, err := ioutil.TempDir(cb.dir, "build-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(copydir)
+
+	// cp -a keeps ownership and permissions, and is quick on btrfs.
+	copyroot := path.Join(copydir, "root")
+	err = runCommand(cn, "", "cp", "-a", "--reflink=auto", cb.rootPath(), copyroot)
+	if err != nil {
+		return nil, err
+	}
+	if err = runCommand(cn, "", "cp", "-a", srcdir, path.Join(copyroot, "build")); err != nil {
+		return nil, err
+	}
+	if err = copyFile(hostResolvConf, path.Join(copyroot, "etc/resolv.conf")); err != nil {
+		return nil, err
+	}
+
+	pkgdest := path.Join(copyroot, "pkgdest")
+	if err = os.Mkdir(pkgdest, 0755); err != nil {
+		return nil, err
+	}
+	err = runCommand(cn, "", "chroot", copyroot, "chown", "-R",
+		ChrootBuildUser, "/build", "/pkgdest")
+	if err != nil {
+		return nil, err
+	}
+
+	builderr := runCommand(cn, "", "unshare", "--mount", "--pid", "--fork",
+		"/bin/sh", "-c", chrootRunnerScript, "sh", copyroot, cb.cachedir)
+	if cn.Canceled() {
+		return nil, ErrCanceled
+	}
+
+	result := &BuildResult{}
+	result.LogPaths, err = collectFiles(path.Join(copyroot, "build"), srcdir,
+		func(name string) bool { return strings.HasSuffix(name, ".log") })
+	if err != nil {
+		return nil, err
+	}
+	if builderr != nil {
+		return result, os.NewError("chroot build failed: " + builderr.String())
+	}
+
+	result.PkgPaths, err = collectFiles(pkgdest, srcdir, isPkgFile)
+	if err != nil {
+		return result, err
+	}
+	if len(result.PkgPaths) == 0 {
+		return result, os.NewError("chroot build did not produce any packages")
+	}
+	return result, nil
+}
+
+// collectFiles copies the files in srcdir whose names match over to destdir,
+// before the build copy they are in is removed. The new paths are returned.
+func collectFiles(srcdir, destdir string, match func(string) bool) ([]string, os.Error) {
+	infos, err := ioutil.ReadDir(srcdir)
+	if err != nil {
+		return nil, err
+	}
+
+	destpaths := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsRegular() || !match(info.Name) {
+			continue
+		}
+		destpath := path.Join(destdir, info.Name)
+		if err := copyFile(path.Join(srcdir, info.Name), destpath); err != nil {
+			return nil, err
+		}
+		destpaths = append(destpaths, destpath)
+	}
+	return destpaths, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"io/ioutil"
+)
+
+// chrootTest is a ChrootBuilder in a temp dir, with the host's files it copies
+// faked too.
+type chrootTest struct {
+	dir           string
+	builder       *ChrootBuilder
+	oldMirrorlist string
+}
+
+func newChrootTest(t *testing.T) *chrootTest {
+	ct := &chrootTest{dir: tempDir(t), oldMirrorlist: hostMirrorlist}
+	hostMirrorlist = path.Join(ct.dir, "mirrorlist")
+	if err := ioutil.WriteFile(hostMirrorlist, []byte("Server = https://x.org/$repo\n"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	// The dirs pacman would make installing base-devel.
+	for _, dir := range []string{"etc/pacman.d", "etc/sudoers.d"} {
+		if err := os.MkdirAll(path.Join(ct.root(), dir), 0755); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	ct.builder = NewChrootBuilder(path.Join(ct.dir, "chroot"), "/var/cache/pacman/pkg")
+	return ct
+}
+
+func (ct *chrootTest) close() {
+	hostMirrorlist = ct.oldMirrorlist
+	os.RemoveAll(ct.dir)
+}
+
+func (ct *chrootTest) root() string {
+	return path.Join(ct.dir, "chroot", "root")
+}
+
+// bootstrap calls Bootstrap from n builds at once.
+func (ct *chrootTest) bootstrap(n int) []os.Error {
+	errs := make(chan os.Error, n)
+	for i := 0; i < n; i++ {
+		go func() { errs <- ct.builder.Bootstrap(NewCanceler()) }()
+	}
+	results := make([]os.Error, n)
+	for i := range results {
+		results[i] = <-errs
+	}
+	return results
+}
+
+func TestChrootBootstrap(t *testing.T) {
+	ct := newChrootTest(t)
+	defer ct.close()
+	fake, restore := useFakeRunner()
+	defer restore()
+
+	for _, err := range ct.bootstrap(4) {
+		if err != nil {
+			t.Fatalf("Bootstrap: %s", err)
+		}
+	}
+	root := ct.root()
+	checkRan(t, fake,
+		"pacman --root "+root+" --cachedir /var/cache/pacman/pkg --noconfirm -Sy base-devel",
+		"chroot "+root+" useradd -m "+ChrootBuildUser)
+
+	if _, err := os.Stat(path.Join(root, chrootMarker)); err != nil {
+		t.Errorf("the chroot wasn't marked complete: %s", err)
+	}
+	data, _ := ioutil.ReadFile(path.Join(root, "etc/pacman.d/mirrorlist"))
+	if string(data) != "Server = https://x.org/$repo\n" {
+		t.Errorf("mirrorlist %q wasn't copied from the host", data)
+	}
+	data, _ = ioutil.ReadFile(path.Join(root, "etc/sudoers.d", ChrootBuildUser))
+	if string(data) != ChrootBuildUser+" ALL = NOPASSWD: /usr/bin/pacman\n" {
+		t.Errorf("sudoers %q", data)
+	}
+}
+
+// A chroot from an earlier run is upgraded once, for fresh sync DBs.
+func TestChrootBootstrapReuse(t *testing.T) {
+	ct := newChrootTest(t)
+	defer ct.close()
+	fake, restore := useFakeRunner()
+	defer restore()
+	if err := ioutil.WriteFile(path.Join(ct.root(), chrootMarker), nil, 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, err := range ct.bootstrap(4) {
+		if err != nil {
+			t.Fatalf("Bootstrap: %s", err)
+		}
+	}
+	checkRan(t, fake,
+		"pacman --root "+ct.root()+" --cachedir /var/cache/pacman/pkg --noconfirm -Syu")
+	if data, _ := ioutil.ReadFile(path.Join(ct.root(), "etc/pacman.d/mirrorlist")); len(data) == 0 {
+		t.Errorf("mirrorlist wasn't copied from the host")
+	}
+}
+
+// A failed bootstrap is tried again by the next build.
+func TestChrootBootstrapFailed(t *testing.T) {
+	ct := newChrootTest(t)
+	defer ct.close()
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["pacman"] = &CmdResult{ExitStatus: 1}
+
+	if err := ct.builder.Bootstrap(NewCanceler()); err == nil {
+		t.Fatalf("Bootstrap succeeded without base-devel")
+	}
+	if _, err := os.Stat(path.Join(ct.root(), chrootMarker)); err == nil {
+		t.Errorf("the failed chroot was marked complete")
+	}
+
+	fake.Results["pacman"] = nil, false
+	if err := ct.builder.Bootstrap(NewCanceler()); err != nil {
+		t.Fatalf("Bootstrap: %s", err)
+	}
+	if ran := fake.Ran(); len(ran) != 3 {
+		t.Errorf("ran %v, want base-devel installed twice and useradd", ran)
+	}
+}
+
+// Build doesn't build anything before the chroot is bootstrapped.
+func TestChrootBuildBootstrapFailed(t *testing.T) {
+	ct := newChrootTest(t)
+	defer ct.close()
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["pacman"] = &CmdResult{ExitStatus: 1}
+
+	if _, err := ct.builder.Build(NewCanceler(), ct.dir); err == nil {
+		t.Errorf("Build succeeded without a chroot")
+	}
+	for _, cmdline := range fake.Ran() {
+		if !strings.HasPrefix(cmdline, "pacman ") {
+			t.Errorf("ran %s", cmdline)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*	download.go
+	Saving downloaded files atomically, so that an interrupted download never
+	leaves a truncated file where a complete one is expected, and resuming
+	interrupted downloads.
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"time"
+	"strings"
+	"syscall"
+	"io/ioutil"
+)
+
+const (
+	// Suffix of the sibling temp file a download is written to before it is
+	// renamed into place. Unusual enough to not clobber anybody else's files
+	// in /tmp.
+	PartialSuffix = ".maw-part"
+
+	// Resumable partial downloads older than this (in seconds) are considered
+	// abandoned and are removed on startup.
+	StalePartialAge = 7 * 24 * 60 * 60
+)
+
+func partialPath(destpath string) string {
+	return destpath + PartialSuffix
+}
+
+// lockPartial opens the partial download for destpath, creating an empty one
+// if there is none, and locks it so that no other download, by this maw or
+// another one, writes to it or removes it while we do. Closing the file
+// releases the lock.
+func lockPartial(destpath string) (*os.File, os.Error) {
+	tmppath := partialPath(destpath)
+	for {
+		partial, err := os.OpenFile(tmppath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err = flockPartial(partial); err != nil {
+			partial.Close()
+			if err == errPartialLocked {
+				err = os.NewError("Download of " + path.Base(destpath) +
+					" is already in progress")
+			}
+			return nil, err
+		}
+		// Whoever had the lock before us may have renamed or removed the
+		// file in the meantime, and then we locked the wrong one.
+		if isPartialAt(partial, tmppath) {
+			return partial, nil
+		}
+		partial.Close()
+	}
+	panic("unreachable")
+}
+
+var errPartialLocked = os.NewError("partial download is locked")
+
+// flockPartial takes the lock of the partial download file without waiting for
+// it. errPartialLocked is returned if somebody else holds it.
+func flockPartial(partial *os.File) os.Error {
+	errno := syscall.Flock(partial.Fd(), syscall.LOCK_EX|syscall.LOCK_NB)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.EWOULDBLOCK:
+		return errPartialLocked
+	}
+	return os.NewSyscallError("flock", errno)
+}
+
+// isPartialAt returns true if the open file partial is the one at tmppath.
+func isPartialAt(partial *os.File, tmppath string) bool {
+	fstat, err := partial.Stat()
+	if err != nil {
+		return false
+	}
+	stat, err := os.Lstat(tmppath)
+	return err == nil && stat.Dev == fstat.Dev && stat.Ino == fstat.Ino
+}
+
+// closePartial releases the lock on a partial download taken by lockPartial.
+// A partial download that is still empty isn't worth keeping.
+func closePartial(partial *os.File) {
+	if stat, err := partial.Stat(); err == nil && stat.Size == 0 &&
+		isPartialAt(partial, partial.Name()) {
+		os.Remove(partial.Name())
+	}
+	partial.Close()
+}
+
+// resumeOffset returns the size of the locked partial download, which is
+// where resuming it starts.
+func resumeOffset(partial *os.File) int64 {
+	stat, err := partial.Stat()
+	if err != nil {
+		return 0
+	}
+	return stat.Size
+}
+
+// saveDownload copies the downloaded data from rdr into a temp file next to
+// destpath. If size is not negative, exactly size bytes must be copied. Once the
+// data is safely on disk the temp file is renamed to destpath. If the copy
+// fails or is canceled, the temp file is removed and destpath is untouched.
+func saveDownload(cn *Canceler, destpath string, rdr io.Reader, size int64) (string, os.Error) {
+	tmppath := partialPath(destpath)
+	destfile, err := lockPartial(destpath)
+	if err != nil {
+		return "", err
+	}
+	defer destfile.Close()
+	if err = cn.AddPartial(tmppath); err != nil {
+		os.Remove(tmppath)
+		return "", err
+	}
+	defer cn.RemovePartial(tmppath)
+
+	if err = destfile.Truncate(0); err == nil {
+		_, err = writeDownload(destfile, rdr, 0, size)
+	}
+	if err == nil {
+		err = os.Rename(tmppath, destpath)
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		if cn.Canceled() {
+			return "", ErrCanceled
+		}
+		return "", err
+	}
+
+	return destpath, nil
+}
+
+// resumeDownload is like saveDownload except that the temp file is the
+// partial download locked by lockPartial, and rdr provides the data starting
+// at offset, which must be its size (see resumeOffset). size is the size of
+// the complete file, or negative if unknown. If verify is not nil, it is
+// called with the path of the complete temp file, which is only renamed to
+// destpath if verify returns nil. The caller still has to close partial.
+//
+// Unlike saveDownload, the temp file is kept if the transfer is interrupted or
+// canceled so that the next attempt can pick up where this one left off. It is
+// only removed if what we got is known to be bad.
+func resumeDownload(cn *Canceler, partial *os.File, destpath string, rdr io.Reader,
+	offset, size int64, verify func(tmppath string) os.Error) (string, os.Error) {
+	tmppath := partial.Name()
+	if cn.Canceled() {
+		return "", ErrCanceled
+	}
+
+	// Throw away anything past offset, in case the file grew in the meantime.
+	err := partial.Truncate(offset)
+	if err == nil {
+		_, err = partial.Seek(offset, 0)
+	}
+	var written int64
+	if err == nil {
+		written, err = writeDownload(partial, rdr, offset, size)
+	}
+	bad := false
+	if err == nil && verify != nil {
+		err = verify(tmppath)
+		bad = err != nil
+	}
+	if err == nil {
+		if err = os.Rename(tmppath, destpath); err == nil {
+			return destpath, nil
+		}
+	}
+
+	switch {
+	case cn.Canceled():
+		return "", ErrCanceled
+	case bad, size >= 0 && offset+written > size, offset+written == 0:
+		// Neither a file that fails verification nor too much data can
+		// be fixed by resuming and an empty file is not worth keeping.
+		os.Remove(tmppath)
+	}
+	return "", err
+}
+
+// writeDownload copies rdr into destfile, checks the size and flushes the file
+// to disk. offset is the number of bytes already in destfile. The number of
+// bytes copied is returned.
+func writeDownload(destfile *os.File, rdr io.Reader, offset, size int64) (int64, os.Error) {
+	written, err := io.Copy(destfile, rdr)
+	if err != nil {
+		return written, err
+	}
+	if size >= 0 && offset+written != size {
+		msg := fmt.Sprintf("Download of %s is truncated: got %d of %d bytes",
+			path.Base(destfile.Name()), offset+written, size)
+		return written, os.NewError(msg)
+	}
+	return written, destfile.Sync()
+}
+
+// removeStalePartials removes temp files left behind in dir by a previous run
+// of maw that was killed before it could clean up after itself. Recent partial
+// downloads are kept so that they can be resumed, and so are those another maw
+// is downloading into right now.
+func removeStalePartials(dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	cutoff := time.Seconds() - StalePartialAge
+	for _, info := range infos {
+		if !info.IsRegular() || !strings.HasSuffix(info.Name, PartialSuffix) ||
+			info.Mtime_ns/1000000000 >= cutoff {
+			continue
+		}
+		tmppath := path.Join(dir, info.Name)
+		partial, err := os.OpenFile(tmppath, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		if flockPartial(partial) == nil && isPartialAt(partial, tmppath) {
+			os.Remove(tmppath)
+		}
+		partial.Close()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path"
+	"sort"
+	"time"
+	"strings"
+	"testing"
+	"io/ioutil"
+)
+
+// A partial download is only ever written by one download at a time.
+func TestLockPartial(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writePartial(t, dir, testPkgContent[:400])
+	destpath := path.Join(dir, testPkgFilename)
+
+	partial, err := lockPartial(destpath)
+	if err != nil {
+		t.Fatalf("lockPartial: %s", err)
+	}
+	if offset := resumeOffset(partial); offset != 400 {
+		t.Errorf("resumeOffset = %d, want 400", offset)
+	}
+	if other, err := lockPartial(destpath); err == nil {
+		other.Close()
+		t.Errorf("locked a partial download twice")
+	} else if !strings.Contains(err.String(), "already in progress") {
+		t.Errorf("lockPartial: %s", err)
+	}
+
+	closePartial(partial)
+	if partial, err = lockPartial(destpath); err != nil {
+		t.Fatalf("lockPartial after closing: %s", err)
+	}
+	closePartial(partial)
+	if data, _ := ioutil.ReadFile(partialPath(destpath)); string(data) != testPkgContent[:400] {
+		t.Errorf("the partial download has %d bytes, want 400", len(data))
+	}
+}
+
+// Locking creates a partial download, but an empty one isn't left behind.
+func TestLockPartialEmpty(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	destpath := path.Join(dir, testPkgFilename)
+
+	partial, err := lockPartial(destpath)
+	if err != nil {
+		t.Fatalf("lockPartial: %s", err)
+	}
+	if offset := resumeOffset(partial); offset != 0 {
+		t.Errorf("resumeOffset = %d, want 0", offset)
+	}
+	closePartial(partial)
+	if names := dirNames(t, dir); len(names) != 0 {
+		t.Errorf("files left behind: %v", names)
+	}
+}
+
+// A download another maw is busy with isn't touched.
+func TestHttpDownloadLocked(t *testing.T) {
+	rs := newRangeServer("range")
+	defer rs.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writePartial(t, dir, testPkgContent[:400])
+	destpath := path.Join(dir, testPkgFilename)
+
+	partial, err := lockPartial(destpath)
+	if err != nil {
+		t.Fatalf("lockPartial: %s", err)
+	}
+	defer partial.Close()
+
+	pf := &PacmanFetcher{pkgdest: dir}
+	if _, err := pf.httpDownload(NewCanceler(), rs.url(t), nil); err == nil {
+		t.Errorf("downloaded into a locked partial download")
+	}
+	checkRanges(t, rs)
+	if data, _ := ioutil.ReadFile(partialPath(destpath)); string(data) != testPkgContent[:400] {
+		t.Errorf("the partial download has %d bytes, want 400", len(data))
+	}
+}
+
+func TestRemoveStalePartials(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeCacheFiles(t, dir, map[string]string{
+		"stale.pkg.tar.zst" + PartialSuffix:  "old",
+		"locked.pkg.tar.zst" + PartialSuffix: "old, but still being downloaded",
+		"recent.pkg.tar.zst" + PartialSuffix: "new",
+		"old.pkg.tar.zst":                    "not a partial download",
+	})
+	old := (time.Seconds() - StalePartialAge - 60) * 1000000000
+	for _, name := range []string{"stale.pkg.tar.zst" + PartialSuffix,
+		"locked.pkg.tar.zst" + PartialSuffix, "old.pkg.tar.zst"} {
+		if err := os.Chtimes(path.Join(dir, name), old, old); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	partial, err := lockPartial(path.Join(dir, "locked.pkg.tar.zst"))
+	if err != nil {
+		t.Fatalf("lockPartial: %s", err)
+	}
+	defer partial.Close()
+
+	removeStalePartials(dir)
+	names := dirNames(t, dir)
+	sort.Strings(names)
+	want := "locked.pkg.tar.zst" + PartialSuffix + " old.pkg.tar.zst recent.pkg.tar.zst" +
+		PartialSuffix
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("left %q, want %q", got, want)
+	}
+}
+
+// A download replaces the old file only once it is complete.
+func TestSaveDownload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	destpath := path.Join(dir, "foo.src.tar.gz")
+	if err := ioutil.WriteFile(destpath, []byte("old"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	rdr := strings.NewReader(testPkgContent[:100])
+	if _, err := saveDownload(NewCanceler(), destpath, rdr, 200); err == nil {
+		t.Errorf("saved a truncated download")
+	}
+	if data, _ := ioutil.ReadFile(destpath); string(data) != "old" {
+		t.Errorf("the truncated download replaced the old file: %q", data)
+	}
+	if _, err := os.Stat(partialPath(destpath)); err == nil {
+		t.Errorf("the truncated download was left behind")
+	}
+
+	rdr = strings.NewReader(testPkgContent)
+	savedpath, err := saveDownload(NewCanceler(), destpath, rdr, int64(len(testPkgContent)))
+	if err != nil || savedpath != destpath {
+		t.Fatalf("saveDownload returned %q, %v", savedpath, err)
+	}
+	if data, _ := ioutil.ReadFile(destpath); string(data) != testPkgContent {
+		t.Errorf("saved %d bytes, want the whole download", len(data))
+	}
+	if names := dirNames(t, dir); len(names) != 1 {
+		t.Errorf("left %v", names)
+	}
+}
+
+// A download of unknown size takes whatever the server sends.
+func TestSaveDownloadUnknownSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	destpath := path.Join(dir, "foo.src.tar.gz")
+
+	rdr := strings.NewReader(testPkgContent)
+	if _, err := saveDownload(NewCanceler(), destpath, rdr, -1); err != nil {
+		t.Fatalf("saveDownload: %s", err)
+	}
+	if data, _ := ioutil.ReadFile(destpath); string(data) != testPkgContent {
+		t.Errorf("saved %d bytes, want the whole download", len(data))
+	}
+}
@@ -0,0 +1,120 @@
+/*	escalate.go
+	Running pacman as root when maw itself is not. Downloads and builds are
+	done as ourselves; only the pacman operations that change the system (-U, -R
+	and -D) are run through sudo, or doas, run0 or pkexec.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"exec"
+	"time"
+	"strings"
+)
+
+const (
+	SudoRefreshInterval = 60e9 // nanoseconds
+)
+
+// The escalation commands we know, in order of preference.
+var EscalateCommands = []string{"sudo", "doas", "run0", "pkexec"}
+
+// Escalator runs commands as root. If we are root already, it does nothing.
+type Escalator struct {
+	name    string // "" if we are root
+	cmdpath string
+	stop    chan bool
+}
+
+// NewEscalator returns an Escalator which uses the command name (a path or the
+// name of one in PATH). If name is empty, the first of EscalateCommands that is
+// installed is used.
+func NewEscalator(name string) (*Escalator, os.Error) {
+	if os.Getuid() == 0 {
+		return &Escalator{}, nil
+	}
+
+	names := EscalateCommands
+	if name != "" {
+		names = []string{name}
+	}
+	for _, name := range names {
+		if cmdpath, err := exec.LookPath(name); err == nil {
+			return &Escalator{name, cmdpath, nil}, nil
+		}
+	}
+	return nil, os.NewError("no command to run pacman as root, tried " +
+		strings.Join(names, ", "))
+}
+
+// Needed returns true if pacman's flag is an operation that must run as root
+// and we are not root. A nil Escalator never escalates.
+func (esc *Escalator) Needed(flag string) bool {
+	if esc == nil || esc.name == "" {
+		return false
+	}
+	return strings.HasPrefix(flag, "-U") || strings.HasPrefix(flag, "-R") ||
+		strings.HasPrefix(flag, "-D")
+}
+
+// Wrap returns a command which runs cmd as root.
+func (esc *Escalator) Wrap(cmd *Command) *Command {
+	wrapped := *cmd
+	wrapped.Name = esc.cmdpath
+	wrapped.Args = append([]string{CmdRunner.Path(cmd.Name)}, cmd.Args...)
+	return &wrapped
+}
+
+// Authenticate asks for the user's password now, before we start on anything
+// that takes long, so that the prompt doesn't show up halfway through. Only
+// sudo can remember that we did; its timestamp is refreshed in the background
+// until Stop is called. The others can't be asked ahead of time, so they
+// prompt every time pacman is run: for each build dependency that is
+// installed, and for the packages at the end. We warn about that here. (doas
+// remembers with the persist option in doas.conf, but only for a while.)
+func (esc *Escalator) Authenticate(cn *Canceler) os.Error {
+	if esc.name == "" || esc.stop != nil {
+		return nil
+	}
+	if esc.name != "sudo" {
+		fmt.Printf("warning: %s can't ask for your password ahead of time, "+
+			"it may ask for it every time pacman is run\n", esc.name)
+		return nil
+	}
+	if err := runCommand(cn, "", esc.cmdpath, "-v"); err != nil {
+		return err
+	}
+	esc.stop = make(chan bool, 1)
+	go esc.refresh(cn)
+	return nil
+}
+
+func (esc *Escalator) refresh(cn *Canceler) {
+	for {
+		select {
+		case <-esc.stop:
+			return
+		case <-time.After(SudoRefreshInterval):
+		}
+		if cn.Canceled() {
+			return
+		}
+
+		// -n makes sudo fail instead of prompting, if the timestamp is gone.
+		cmd := &Command{Name: esc.cmdpath, Args: []string{"-n", "-v"},
+			Capture: true, Quiet: true}
+		if _, err := CmdRunner.Run(cn, cmd); err != nil {
+			return
+		}
+	}
+}
+
+// Stop stops refreshing sudo's timestamp.
+func (esc *Escalator) Stop() {
+	if esc.stop != nil {
+		esc.stop <- true
+		esc.stop = nil
+	}
+}
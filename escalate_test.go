@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAuthenticateSudo(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+
+	esc := testEscalator()
+	if err := esc.Authenticate(NewCanceler()); err != nil {
+		t.Fatalf("Authenticate: %s", err)
+	}
+	esc.Stop()
+	checkRan(t, fake, "/usr/bin/sudo -v")
+}
+
+// The other escalators can't authenticate ahead of time; they are only
+// warned about.
+func TestAuthenticateOthers(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+
+	for _, name := range []string{"doas", "run0", "pkexec"} {
+		esc := &Escalator{name: name, cmdpath: "/usr/bin/" + name}
+		if err := esc.Authenticate(NewCanceler()); err != nil {
+			t.Errorf("%s: Authenticate: %s", name, err)
+		}
+		esc.Stop()
+	}
+	checkRan(t, fake)
+}
+
+func TestEscalatorWrap(t *testing.T) {
+	esc := &Escalator{name: "doas", cmdpath: "/usr/bin/doas"}
+	cmd := esc.Wrap(&Command{Name: "/usr/bin/pacman", Args: []string{"-U", "foo.pkg.tar.zst"}})
+	if cmd.String() != "/usr/bin/doas /usr/bin/pacman -U foo.pkg.tar.zst" {
+		t.Errorf("wrapped: %s", cmd)
+	}
+	for flag, want := range map[string]bool{"-U": true, "-Rns": true, "-D": true, "-Q": false, "-T": false} {
+		if esc.Needed(flag) != want {
+			t.Errorf("Needed(%q) = %v", flag, !want)
+		}
+	}
+	if (&Escalator{}).Needed("-U") {
+		t.Errorf("escalating as root")
+	}
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 )
 
 type FetchError interface {
@@ -60,8 +61,47 @@ func (wrap *FetchErrorWrapper) NotFound() bool {
 	return false
 }
 
+// MultiFetchError collects the errors of every target that failed to be fetched
+// by MultiFetcher.FetchAll. Targets and Errors are parallel slices.
+type MultiFetchError struct {
+	Targets []string
+	Errors  []FetchError
+}
+
+func (merr *MultiFetchError) add(pkgname string, err FetchError) {
+	merr.Targets = append(merr.Targets, pkgname)
+	merr.Errors = append(merr.Errors, err)
+}
+
+// String lists each failed target on its own line, with its reason.
+func (merr *MultiFetchError) String() string {
+	lines := make([]string, len(merr.Targets))
+	for i, pkgname := range merr.Targets {
+		err := merr.Errors[i]
+		if err.NotFound() {
+			lines[i] = fmt.Sprintf("%s: target not found", pkgname)
+		} else {
+			lines[i] = fmt.Sprintf("%s: %s", pkgname, err.String())
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NotFound returns true only if every failed target was simply not found.
+// A single download or build error makes the whole thing a "real" error.
+func (merr *MultiFetchError) NotFound() bool {
+	for _, err := range merr.Errors {
+		if !err.NotFound() {
+			return false
+		}
+	}
+	return true
+}
+
+// A PackageFetcher fetches the package files for pkgname. Long-running work
+// (downloads, builds) must register with cn so that it can be interrupted.
 type PackageFetcher interface {
-	Fetch(pkgname string) ([]string, FetchError)
+	Fetch(cn *Canceler, pkgname string) ([]string, FetchError)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -81,42 +121,55 @@ func NewMultiFetcher(fetchers ...PackageFetcher) *MultiFetcher {
 	return &MultiFetcher{fetchers}
 }
 
-func (mf *MultiFetcher) FetchAll(pkgnames []string) ([]string, os.Error) {
+// FetchAll fetches every package in pkgnames concurrently. Every fetch is
+// waited for, even after one has failed, so that no builds are left running
+// behind our back. The paths of all packages that were successfully fetched are
+// returned. If any fetch failed, a *MultiFetchError listing every failure is
+// returned as well.
+func (mf *MultiFetcher) FetchAll(cn *Canceler, pkgnames []string) ([]string, os.Error) {
 	// Packages are all fetched concurrently, independent of each other
 	chans := make([]chan *fetchResult, len(pkgnames))
 	for i, pkgname := range pkgnames {
 		r := make(chan *fetchResult, 1)
-		go mf.chanFetch(pkgname, r)
+		go mf.chanFetch(cn, pkgname, r)
 		chans[i] = r
 	}
 
 	// Waits for all goroutines to finish, collecting results
 	allpkgpaths := make([]string, 0, 256) // TODO: use cap or something?
-	for _, c := range chans {
+	failures := &MultiFetchError{}
+	for i, c := range chans {
 		result := <-c
 		if result.error == nil {
 			allpkgpaths = append(allpkgpaths, result.pkgs...)
 		} else {
-			return nil, result.error
+			failures.add(pkgnames[i], result.error)
 		}
 	}
 
+	if len(failures.Targets) > 0 {
+		return allpkgpaths, failures
+	}
 	return allpkgpaths, nil
 }
 
 // chanFetch is a simple wrapper to make Fetch more concurrent.
-func (mf *MultiFetcher) chanFetch(pkgname string, results chan *fetchResult) {
-	paths, err := mf.Fetch(pkgname)
+func (mf *MultiFetcher) chanFetch(cn *Canceler, pkgname string, results chan *fetchResult) {
+	paths, err := mf.Fetch(cn, pkgname)
 	results <- &fetchResult{paths, err}
 }
 
-func (mf *MultiFetcher) Fetch(pkgname string) ([]string, FetchError) {
+func (mf *MultiFetcher) Fetch(cn *Canceler, pkgname string) ([]string, FetchError) {
 	var pkgpaths []string
 
 SearchLoop:
 	for _, fetcher := range mf.fetchers {
+		if cn.Canceled() {
+			return nil, FetchErrorWrap(pkgname, ErrCanceled)
+		}
+
 		var err FetchError
-		pkgpaths, err = fetcher.Fetch(pkgname)
+		pkgpaths, err = fetcher.Fetch(cn, pkgname)
 		if pkgpaths != nil {
 			return pkgpaths, nil
 		} else {
@@ -32,14 +32,21 @@ var (
 type FtpConn struct {
 	state, pendingTransfers int
 	p                       *proto.Conn
+	dconn                   net.Conn // data connection of the current transfer
+	cn                      *Canceler
 }
 
-func DialFtp(addr string) (*FtpConn, os.Error) {
+// DialFtp connects to the FTP server at addr. Both the control connection and
+// any data connections are closed if cn is canceled.
+func DialFtp(cn *Canceler, addr string) (*FtpConn, os.Error) {
 	conn, err := proto.Dial("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
-	return &FtpConn{PreLogin, 0, conn}, nil
+	if err = cn.AddCloser(conn); err != nil {
+		return nil, err
+	}
+	return &FtpConn{PreLogin, 0, conn, nil, cn}, nil
 }
 
 func (ftp *FtpConn) expectResp(expectedCode int) (string, os.Error) {
@@ -92,39 +99,69 @@ func (ftp *FtpConn) anonLogin() os.Error {
 	return nil
 }
 
-func (ftp *FtpConn) Fetch(rpath string) (io.Reader, os.Error) {
-	var err os.Error
+// login logs in anonymously, unless we already are logged in.
+func (ftp *FtpConn) login() os.Error {
 	switch ftp.state {
 	case PostLogout: // wtf?
 		ftp.p.PrintfLine("REIN")
 		fallthrough
 	case PreLogin:
-		err = ftp.anonLogin()
+		return ftp.anonLogin()
 	case LoggedIn:
 		// awesome, nothing to do
 	}
+	return nil
+}
 
-	if err != nil {
-		return nil, err
+// binaryMode sets the data transmission type. The default type is ASCII, be
+// sure to set it to Image (binary).
+func (ftp *FtpConn) binaryMode() os.Error {
+	if err := ftp.p.PrintfLine("TYPE I"); err != nil {
+		return err
 	}
+	_, err := ftp.expectResp(200)
+	return err
+}
 
-	// The default data transmission type is ASCII, be sure to set it to Image (binary)
-	if err := ftp.p.PrintfLine("TYPE I"); err != nil {
-		return nil, err
+// Size asks the server for the size of the file at rpath. The SIZE command is
+// an extension which not every server supports.
+func (ftp *FtpConn) Size(rpath string) (int64, os.Error) {
+	if err := ftp.login(); err != nil {
+		return 0, err
+	}
+	if err := ftp.binaryMode(); err != nil {
+		return 0, dlError(err)
+	}
+
+	if err := ftp.p.PrintfLine("SIZE %s", rpath); err != nil {
+		return 0, err
 	}
-	_, err = ftp.expectResp(200)
+	msg, err := ftp.expectResp(213)
 	if err != nil {
-		return nil, dlError(err)
+		return 0, err
+	}
+	return strconv.Atoi64(strings.TrimSpace(msg))
+}
+
+// Fetch starts downloading the file at rpath, skipping the first offset bytes.
+// If the server refuses to restart the transfer at offset, the whole file is
+// sent instead. The returned offset is the one the transfer actually starts at.
+func (ftp *FtpConn) Fetch(rpath string, offset int64) (io.Reader, int64, os.Error) {
+	if err := ftp.login(); err != nil {
+		return nil, 0, err
+	}
+	if err := ftp.binaryMode(); err != nil {
+		return nil, 0, dlError(err)
 	}
 
 	// Make sure we use passive mode for downloading. With passive mode the client
 	// starts the data connection to the server, not the other way around.
 	if err := ftp.p.PrintfLine("PASV"); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	msg, err := ftp.expectResp(227)
 	if err != nil {
-		return nil, dlError(err)
+		return nil, 0, dlError(err)
 	}
 
 	var addrstr string
@@ -134,27 +171,44 @@ func (ftp *FtpConn) Fetch(rpath string) (io.Reader, os.Error) {
 			goto PasvSuccess
 		}
 	}
-	return nil, os.NewError("Failed to download, server failed to enter passive mode")
+	return nil, 0, os.NewError("Failed to download, server failed to enter passive mode")
 
 PasvSuccess:
 	// Get our data connection ready.
 	dconn, err := net.Dial("tcp", addrstr)
 	if err != nil {
-		return nil, dlError(err)
+		return nil, 0, dlError(err)
+	}
+	if err = ftp.cn.AddCloser(dconn); err != nil {
+		return nil, 0, err
+	}
+	ftp.dconn = dconn
+
+	// The REST command must immediately precede RETR.
+	if offset > 0 {
+		if err := ftp.p.PrintfLine("REST %d", offset); err != nil {
+			return nil, 0, err
+		}
+		if _, err = ftp.expectResp(350); err != nil {
+			// No resuming for us, start from the beginning.
+			offset = 0
+		}
 	}
 
 	// Now we can signal the server to start the file transfer.
 	if err := ftp.p.PrintfLine("RETR %s", rpath); err != nil {
 		dconn.Close()
-		return nil, err
+		return nil, 0, err
 	}
 	_, err = ftp.expectResp(150)
 	if err != nil {
 		dconn.Close()
-		return nil, dlError(err)
+		return nil, 0, dlError(err)
 	}
+	// The server sends 226 once it has sent the whole file.
+	ftp.pendingTransfers++
 
-	return dconn, nil
+	return dconn, offset, nil
 }
 
 func loginError(err os.Error) os.Error {
@@ -209,8 +263,16 @@ func (ftp *FtpConn) Quit() os.Error {
 }
 
 func (ftp *FtpConn) Close() os.Error {
-	if ftp.state == LoggedIn {
+	if ftp.dconn != nil {
+		ftp.cn.RemoveCloser(ftp.dconn)
+		ftp.dconn.Close()
+		ftp.dconn = nil
+	}
+	defer ftp.cn.RemoveCloser(ftp.p)
+
+	if ftp.state == LoggedIn && !ftp.cn.Canceled() {
 		if err := ftp.Quit(); err != nil {
+			ftp.p.Close()
 			return err
 		}
 	}
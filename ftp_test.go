@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io"
+	"os"
+	"net"
+	proto "net/textproto"
+	"fmt"
+	"http"
+	"strings"
+	"strconv"
+	"testing"
+)
+
+// ftpServer is just enough of an FTP server to serve testPkgContent to one
+// client, in passive mode. If noRest is true it refuses to restart transfers.
+type ftpServer struct {
+	listener net.Listener
+	noRest   bool
+	rests    []int64 // the offsets the client asked to restart at
+	done     chan bool
+}
+
+func startFtpServer(t *testing.T, noRest bool) *ftpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	fs := &ftpServer{listener: listener, noRest: noRest, done: make(chan bool, 1)}
+	go fs.serve()
+	return fs
+}
+
+func (fs *ftpServer) url(t *testing.T) *http.URL {
+	url, err := http.ParseURL(fmt.Sprintf("ftp://%s/core/os/x86_64/%s",
+		fs.listener.Addr().String(), testPkgFilename))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return url
+}
+
+// wait waits for the client to hang up and stops the server.
+func (fs *ftpServer) wait() {
+	<-fs.done
+	fs.listener.Close()
+}
+
+func (fs *ftpServer) serve() {
+	defer func() { fs.done <- true }()
+	conn, err := fs.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	p := proto.NewConn(conn)
+	p.PrintfLine("220 maw test server")
+	var datalistener net.Listener
+	var rest int64
+	for {
+		line, err := p.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg := line, ""
+		if idx := strings.Index(line, " "); idx != -1 {
+			cmd, arg = line[:idx], line[idx+1:]
+		}
+
+		switch cmd {
+		case "USER":
+			p.PrintfLine("331 Send a password")
+		case "PASS":
+			p.PrintfLine("230 Logged in")
+		case "TYPE":
+			p.PrintfLine("200 Type set")
+		case "SIZE":
+			p.PrintfLine("213 %d", len(testPkgContent))
+		case "PASV":
+			if datalistener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				p.PrintfLine("425 %s", err)
+				break
+			}
+			port := datalistener.Addr().(*net.TCPAddr).Port
+			p.PrintfLine("227 Entering Passive Mode (127,0,0,1,%d,%d).", port>>8, port&0xff)
+		case "REST":
+			if fs.noRest {
+				p.PrintfLine("502 REST not implemented")
+				break
+			}
+			rest, _ = strconv.Atoi64(arg)
+			fs.rests = append(fs.rests, rest)
+			p.PrintfLine("350 Restarting at %d", rest)
+		case "RETR":
+			if datalistener == nil {
+				p.PrintfLine("425 Use PASV first")
+				break
+			}
+			dataconn, err := datalistener.Accept()
+			datalistener.Close()
+			datalistener = nil
+			if err != nil {
+				p.PrintfLine("425 %s", err)
+				break
+			}
+			p.PrintfLine("150 Sending %s", arg)
+			io.WriteString(dataconn, testPkgContent[rest:])
+			dataconn.Close()
+			p.PrintfLine("226 Transfer complete")
+			rest = 0
+		case "QUIT":
+			p.PrintfLine("221 Bye")
+			return
+		default:
+			p.PrintfLine("502 %s not implemented", cmd)
+		}
+	}
+}
+
+func TestFtpDownload(t *testing.T) {
+	fs := startFtpServer(t, false)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	pf := &PacmanFetcher{pkgdest: dir}
+	pkgpath, err := pf.ftpDownload(NewCanceler(), fs.url(t), nil)
+	fs.wait()
+	checkDownloaded(t, dir, pkgpath, err)
+	if len(fs.rests) != 0 {
+		t.Errorf("REST sent without a partial download: %v", fs.rests)
+	}
+}
+
+func TestFtpDownloadResume(t *testing.T) {
+	fs := startFtpServer(t, false)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writePartial(t, dir, testPkgContent[:300])
+
+	pf := &PacmanFetcher{pkgdest: dir}
+	pkgpath, err := pf.ftpDownload(NewCanceler(), fs.url(t), nil)
+	fs.wait()
+	checkDownloaded(t, dir, pkgpath, err)
+	if len(fs.rests) != 1 || fs.rests[0] != 300 {
+		t.Errorf("REST offsets %v, want [300]", fs.rests)
+	}
+}
+
+// A server without REST sends the whole file, which replaces the partial
+// download.
+func TestFtpDownloadNoRest(t *testing.T) {
+	fs := startFtpServer(t, true)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writePartial(t, dir, strings.Repeat("x", 300))
+
+	pf := &PacmanFetcher{pkgdest: dir}
+	pkgpath, err := pf.ftpDownload(NewCanceler(), fs.url(t), nil)
+	fs.wait()
+	checkDownloaded(t, dir, pkgpath, err)
+}
+
+// A partial download as big as the whole file can't be resumed.
+func TestFtpDownloadPartialTooBig(t *testing.T) {
+	fs := startFtpServer(t, false)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writePartial(t, dir, strings.Repeat("x", len(testPkgContent)+10))
+
+	pf := &PacmanFetcher{pkgdest: dir}
+	pkgpath, err := pf.ftpDownload(NewCanceler(), fs.url(t), nil)
+	fs.wait()
+	checkDownloaded(t, dir, pkgpath, err)
+	if len(fs.rests) != 0 {
+		t.Errorf("REST sent for a partial download that is too big: %v", fs.rests)
+	}
+}
@@ -0,0 +1,82 @@
+/*	localdb.go
+	Reading pacman's local database, which describes installed packages.
+*/
+
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"io/ioutil"
+)
+
+// LocalDB is pacman's database of installed packages, i.e. /var/lib/pacman/local
+// Each installed package has a <pkgname>-<pkgver>-<pkgrel> directory in it.
+type LocalDB struct {
+	path string
+}
+
+// OpenLocalDB returns the local database. If conf is not nil, its DBPath
+// setting is used.
+func OpenLocalDB(conf *PacmanConf) *LocalDB {
+	dbpath := DefaultDBPath
+	if conf != nil && conf.Options.Get("DBPath") != "" {
+		dbpath = conf.Options.Get("DBPath")
+	}
+	return &LocalDB{path.Join(dbpath, "local")}
+}
+
+// Installed returns the names of installed packages mapped to their full
+// versions (<pkgver>-<pkgrel>, with the epoch if there is one).
+func (db *LocalDB) Installed() (map[string]string, os.Error) {
+	infos, err := ioutil.ReadDir(db.path)
+	if err != nil {
+		return nil, err
+	}
+
+	installed := make(map[string]string, len(infos))
+	for _, info := range infos {
+		if !info.IsDirectory() {
+			continue
+		}
+		pkgname := entryPkgName(info.Name)
+		if pkgname == "" {
+			continue
+		}
+		installed[pkgname] = info.Name[len(pkgname)+1:]
+	}
+	return installed, nil
+}
+
+// FileOwners returns the files of installed packages mapped to the names of the
+// packages that own them. Directories are shared, so they are left out.
+func (db *LocalDB) FileOwners() (map[string]string, os.Error) {
+	infos, err := ioutil.ReadDir(db.path)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]string, 1024)
+	for _, info := range infos {
+		pkgname := entryPkgName(info.Name)
+		if !info.IsDirectory() || pkgname == "" {
+			continue
+		}
+		file, err := os.Open(path.Join(db.path, info.Name, "files"))
+		if err != nil {
+			return nil, err
+		}
+		files, err := ParsePkgDesc(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, filepath := range files["FILES"] {
+			if !strings.HasSuffix(filepath, "/") {
+				owners[filepath] = pkgname
+			}
+		}
+	}
+	return owners, nil
+}
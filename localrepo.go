@@ -0,0 +1,351 @@
+/*	localrepo.go
+	A local package repository for the packages we build. This does the same
+	job as repo-add: built packages are copied into the repo directory and
+	the repo's .db and .files databases are updated, so the directory can be
+	used by pacman through a Server = file:// (or http://) line.
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"bytes"
+	"strings"
+	"strconv"
+	"io/ioutil"
+	"archive/tar"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/base64"
+	"compress/gzip"
+)
+
+// Order of fields in desc entries and the .PKGINFO keys they come from.
+var descFields = [][2]string{
+	{"NAME", "pkgname"}, {"BASE", "pkgbase"}, {"VERSION", "pkgver"},
+	{"DESC", "pkgdesc"}, {"GROUPS", "group"}, {"URL", "url"},
+	{"LICENSE", "license"}, {"ARCH", "arch"}, {"BUILDDATE", "builddate"},
+	{"PACKAGER", "packager"}, {"ISIZE", "size"}, {"REPLACES", "replaces"},
+	{"CONFLICTS", "conflict"}, {"PROVIDES", "provides"},
+	{"DEPENDS", "depend"}, {"OPTDEPENDS", "optdepend"},
+	{"MAKEDEPENDS", "makedepend"}, {"CHECKDEPENDS", "checkdepend"},
+}
+
+// LocalRepo is a package repository in a local directory. The repo is named
+// after the directory. It is safe to add packages from many goroutines.
+type LocalRepo struct {
+	dir  string
+	name string
+	lock sync.Mutex
+}
+
+func NewLocalRepo(dir string) *LocalRepo {
+	return &LocalRepo{dir: dir, name: path.Base(dir)}
+}
+
+func (repo *LocalRepo) dbPath(kind string) string {
+	return path.Join(repo.dir, repo.name+"."+kind+".tar.gz")
+}
+
+// repoEntry is a package's entry in a repo database. Its files are named by
+// their path inside the entry directory ("desc", "files").
+type repoEntry struct {
+	dirname string
+	files   map[string][]byte
+}
+
+// removeFiles removes the package file of the entry (and its .sig) from
+// repodir, unless it is one of the files in keeppaths.
+func (entry *repoEntry) removeFiles(repodir string, keeppaths []string) {
+	desc, err := ParsePkgDesc(bytes.NewBuffer(entry.files["desc"]))
+	if err != nil || desc.Get("FILENAME") == "" {
+		return
+	}
+	oldpath := path.Join(repodir, path.Base(desc.Get("FILENAME")))
+	if !containsString(keeppaths, oldpath) {
+		os.Remove(oldpath)
+		os.Remove(oldpath + ".sig")
+	}
+}
+
+// Add copies the package files at pkgpaths (and their .sig files, if any) into
+// the repo and adds them to the databases, replacing older versions of the
+// same packages. The package files of older versions are removed once the
+// databases no longer refer to them. The paths of the copies are returned. Packages are read with ReadBinPkg, which is
+// interrupted if cn is canceled.
+func (repo *LocalRepo) Add(cn *Canceler, pkgpaths []string) ([]string, os.Error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err := os.MkdirAll(repo.dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := repo.readEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	repopaths := make([]string, len(pkgpaths))
+	var superseded []*repoEntry
+	for i, pkgpath := range pkgpaths {
+		repopath := path.Join(repo.dir, path.Base(pkgpath))
+		if err := copyFile(pkgpath, repopath); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(pkgpath + ".sig"); err == nil {
+			if err := copyFile(pkgpath+".sig", repopath+".sig"); err != nil {
+				return nil, err
+			}
+		}
+
+		entry, pkgname, err := newRepoEntry(cn, repopath)
+		if err != nil {
+			return nil, err
+		}
+		if old, ok := entries[pkgname]; ok {
+			superseded = append(superseded, old)
+		}
+		entries[pkgname] = entry
+		repopaths[i] = repopath
+	}
+
+	if err := repo.writeDB("db", entries, false); err != nil {
+		return nil, err
+	}
+	if err := repo.writeDB("files", entries, true); err != nil {
+		return nil, err
+	}
+	for _, old := range superseded {
+		old.removeFiles(repo.dir, repopaths)
+	}
+	return repopaths, nil
+}
+
+// readEntries reads the existing entries of the repo, keyed by package name.
+// The .files database has everything the .db has, and more, so we read that.
+func (repo *LocalRepo) readEntries() (map[string]*repoEntry, os.Error) {
+	entries := make(map[string]*repoEntry)
+	if _, err := os.Stat(repo.dbPath("files")); err != nil {
+		// A new repo.
+		return entries, nil
+	}
+
+	file, err := os.Open(repo.dbPath("files"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	unzipper, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer unzipper.Close()
+
+	rdr := tar.NewReader(unzipper)
+	for {
+		hdr, err := rdr.Next()
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		dir, name := path.Split(hdr.Name)
+		dir = strings.TrimRight(dir, "/")
+		pkgname := entryPkgName(dir)
+		if pkgname == "" {
+			continue
+		}
+		data, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			return nil, err
+		}
+
+		entry, ok := entries[pkgname]
+		if !ok {
+			entry = &repoEntry{dir, make(map[string][]byte)}
+			entries[pkgname] = entry
+		}
+		entry.files[name] = data
+	}
+
+	return entries, nil
+}
+
+// writeDB writes the repo database of the given kind ("db" or "files") and
+// points the <reponame>.<kind> symlink at it, like repo-add does. The files
+// lists are only included if withFiles is true.
+func (repo *LocalRepo) writeDB(kind string, entries map[string]*repoEntry, withFiles bool) os.Error {
+	dbpath := repo.dbPath(kind)
+	tmppath := partialPath(dbpath)
+	file, err := os.Create(tmppath)
+	if err != nil {
+		return err
+	}
+
+	err = writeDBEntries(file, entries, withFiles)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmppath, dbpath)
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+
+	linkpath := path.Join(repo.dir, repo.name+"."+kind)
+	os.Remove(linkpath)
+	return os.Symlink(path.Base(dbpath), linkpath)
+}
+
+func writeDBEntries(wtr io.Writer, entries map[string]*repoEntry, withFiles bool) os.Error {
+	zipper, err := gzip.NewWriter(wtr)
+	if err != nil {
+		return err
+	}
+	tarwtr := tar.NewWriter(zipper)
+
+	// Sorted, so the database only changes when the packages do.
+	pkgnames := make([]string, 0, len(entries))
+	for pkgname, _ := range entries {
+		pkgnames = append(pkgnames, pkgname)
+	}
+	sort.SortStrings(pkgnames)
+
+	for _, pkgname := range pkgnames {
+		entry := entries[pkgname]
+		hdr := &tar.Header{Name: entry.dirname + "/", Mode: 0755,
+			Typeflag: tar.TypeDir}
+		if err := tarwtr.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		for _, name := range []string{"desc", "files"} {
+			data, ok := entry.files[name]
+			if !ok || (name == "files" && !withFiles) {
+				continue
+			}
+			hdr := &tar.Header{Name: entry.dirname + "/" + name, Mode: 0644,
+				Size: int64(len(data)), Typeflag: tar.TypeReg}
+			if err := tarwtr.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tarwtr.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tarwtr.Close(); err != nil {
+		return err
+	}
+	return zipper.Close()
+}
+
+// newRepoEntry creates the database entry for the package file at pkgpath. The
+// name of the package is returned as well.
+func newRepoEntry(cn *Canceler, pkgpath string) (*repoEntry, string, os.Error) {
+	pkg, err := ReadBinPkg(cn, pkgpath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	desc := bytes.NewBuffer(nil)
+	writeDescField := func(field string, vals []string) {
+		if len(vals) > 0 {
+			fmt.Fprintf(desc, "%%%s%%\n%s\n\n", field, strings.Join(vals, "\n"))
+		}
+	}
+
+	writeDescField("FILENAME", []string{path.Base(pkgpath)})
+	for _, field := range descFields {
+		writeDescField(field[0], pkg.Info[field[1]])
+	}
+
+	stat, err := os.Stat(pkgpath)
+	if err != nil {
+		return nil, "", err
+	}
+	writeDescField("CSIZE", []string{strconv.Itoa64(stat.Size)})
+
+	md5sum, sha256sum, err := pkgChecksums(pkgpath)
+	if err != nil {
+		return nil, "", err
+	}
+	writeDescField("MD5SUM", []string{md5sum})
+	writeDescField("SHA256SUM", []string{sha256sum})
+	if sig, err := ioutil.ReadFile(pkgpath + ".sig"); err == nil {
+		encsig := make([]byte, base64.StdEncoding.EncodedLen(len(sig)))
+		base64.StdEncoding.Encode(encsig, sig)
+		writeDescField("PGPSIG", []string{string(encsig)})
+	}
+
+	files := bytes.NewBuffer(nil)
+	files.WriteString("%FILES%\n")
+	for _, name := range pkg.FileList() {
+		files.WriteString(name + "\n")
+	}
+	files.WriteString("\n")
+
+	dirname := pkg.Name() + "-" + pkg.Version()
+	entry := &repoEntry{dirname, map[string][]byte{
+		"desc": desc.Bytes(), "files": files.Bytes()}}
+	return entry, pkg.Name(), nil
+}
+
+func pkgChecksums(pkgpath string) (md5sum, sha256sum string, err os.Error) {
+	file, err := os.Open(pkgpath)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	md5hash, sha256hash := md5.New(), sha256.New()
+	if _, err = io.Copy(io.MultiWriter(md5hash, sha256hash), file); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(md5hash.Sum()), hex.EncodeToString(sha256hash.Sum()), nil
+}
+
+// copyFile copies the file at srcpath to destpath, atomically.
+func copyFile(srcpath, destpath string) os.Error {
+	if srcpath == destpath {
+		return nil
+	}
+	src, err := os.Open(srcpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmppath := partialPath(destpath)
+	dest, err := os.Create(tmppath)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dest, src); err == nil {
+		err = dest.Sync()
+	}
+	dest.Close()
+	if err == nil {
+		err = os.Rename(tmppath, destpath)
+	}
+	if err != nil {
+		os.Remove(tmppath)
+	}
+	return err
+}
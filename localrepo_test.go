@@ -0,0 +1,205 @@
+package main
+
+import (
+	"os"
+	"path"
+	"bytes"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"archive/tar"
+	"compress/gzip"
+)
+
+// repoTestInfo is the .PKGINFO of the packages in the test repos, past the
+// name and version.
+const repoTestInfo = "pkgdesc = A test package\narch = x86_64\nsize = 4096\n" +
+	"depend = glibc\ndepend = bar>=1.0\nlicense = GPL\n"
+
+// writeRepoTestPkg writes the package pkgname of version to dir, and returns
+// its path.
+func writeRepoTestPkg(t *testing.T, dir, pkgname, version string) string {
+	pkgpath := path.Join(dir, pkgname+"-"+version+"-x86_64.pkg.tar.gz")
+	writeBinPkg(t, pkgpath, pkgname, version, repoTestInfo, "usr/bin/"+pkgname)
+	return pkgpath
+}
+
+// readDBNames returns the names of the entries of the repo database data.
+func readDBNames(t *testing.T, data []byte) []string {
+	unzipper, err := gzip.NewReader(bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	var names []string
+	rdr := tar.NewReader(unzipper)
+	for {
+		hdr, err := rdr.Next()
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func TestNewRepoEntry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	pkgpath := writeRepoTestPkg(t, dir, "foo", "1.0-1")
+	if err := ioutil.WriteFile(pkgpath+".sig", []byte("sig"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	entry, pkgname, err := newRepoEntry(NewCanceler(), pkgpath)
+	if err != nil {
+		t.Fatalf("newRepoEntry: %s", err)
+	}
+	if pkgname != "foo" || entry.dirname != "foo-1.0-1" {
+		t.Errorf("got %s in %s, want foo in foo-1.0-1", pkgname, entry.dirname)
+	}
+	desc, err := ParsePkgDesc(bytes.NewBuffer(entry.files["desc"]))
+	if err != nil {
+		t.Fatalf("ParsePkgDesc: %s", err)
+	}
+	want := map[string]string{
+		"FILENAME": path.Base(pkgpath), "NAME": "foo", "VERSION": "1.0-1",
+		"DESC": "A test package", "ARCH": "x86_64", "ISIZE": "4096",
+		"LICENSE": "GPL", "DEPENDS": "glibc|bar>=1.0", "PGPSIG": "c2ln",
+	}
+	for field, want := range want {
+		if got := strings.Join(desc[field], "|"); got != want {
+			t.Errorf("%%%s%% = %q, want %q", field, got, want)
+		}
+	}
+	if len(desc.Get("CSIZE")) == 0 || len(desc.Get("MD5SUM")) != 32 ||
+		len(desc.Get("SHA256SUM")) != 64 {
+		t.Errorf("size and checksums %q %q %q", desc.Get("CSIZE"), desc.Get("MD5SUM"),
+			desc.Get("SHA256SUM"))
+	}
+	if files := string(entry.files["files"]); files != "%FILES%\nusr/bin/foo\n\n" {
+		t.Errorf("files = %q", files)
+	}
+}
+
+// The entries written to a database are read back as they were, and the .db
+// is the .files without the files lists.
+func TestRepoDBRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	repo := NewLocalRepo(path.Join(dir, "maw"))
+	if err := os.MkdirAll(repo.dir, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	entries := make(map[string]*repoEntry)
+	for _, pkgname := range []string{"foo", "bar-baz"} {
+		pkgpath := writeRepoTestPkg(t, dir, pkgname, "1:2.0-1")
+		entry, _, err := newRepoEntry(NewCanceler(), pkgpath)
+		if err != nil {
+			t.Fatalf("newRepoEntry: %s", err)
+		}
+		entries[pkgname] = entry
+	}
+	for _, kind := range []string{"db", "files"} {
+		if err := repo.writeDB(kind, entries, kind == "files"); err != nil {
+			t.Fatalf("writeDB %s: %s", kind, err)
+		}
+	}
+
+	read, err := repo.readEntries()
+	if err != nil {
+		t.Fatalf("readEntries: %s", err)
+	}
+	if len(read) != len(entries) {
+		t.Errorf("read %d entries, want %d", len(read), len(entries))
+	}
+	for pkgname, entry := range entries {
+		got, ok := read[pkgname]
+		if !ok {
+			t.Errorf("%s wasn't read", pkgname)
+			continue
+		}
+		if got.dirname != entry.dirname {
+			t.Errorf("%s: read dir %s, want %s", pkgname, got.dirname, entry.dirname)
+		}
+		for _, name := range []string{"desc", "files"} {
+			if !bytes.Equal(got.files[name], entry.files[name]) {
+				t.Errorf("%s: read %s %q, want %q", pkgname, name, got.files[name],
+					entry.files[name])
+			}
+		}
+	}
+
+	data, err := ioutil.ReadFile(path.Join(repo.dir, "maw.db"))
+	if err != nil {
+		t.Fatalf("the maw.db link: %s", err)
+	}
+	names := strings.Join(readDBNames(t, data), " ")
+	if names != "bar-baz-1:2.0-1/ bar-baz-1:2.0-1/desc foo-1:2.0-1/ foo-1:2.0-1/desc" {
+		t.Errorf("maw.db has %s", names)
+	}
+}
+
+func TestLocalRepoAdd(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	repo := NewLocalRepo(path.Join(dir, "maw"))
+
+	oldpath := writeRepoTestPkg(t, dir, "foo", "1.0-1")
+	if _, err := repo.Add(NewCanceler(), []string{oldpath}); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	newpath := writeRepoTestPkg(t, dir, "foo", "1.1-1")
+	repopaths, err := repo.Add(NewCanceler(), []string{newpath})
+	if err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if len(repopaths) != 1 || repopaths[0] != path.Join(repo.dir, path.Base(newpath)) {
+		t.Errorf("Add returned %v", repopaths)
+	}
+
+	if _, err := os.Stat(path.Join(repo.dir, path.Base(oldpath))); err == nil {
+		t.Errorf("the old version was kept")
+	}
+	entries, err := repo.readEntries()
+	if err != nil {
+		t.Fatalf("readEntries: %s", err)
+	}
+	if len(entries) != 1 || entries["foo"] == nil || entries["foo"].dirname != "foo-1.1-1" {
+		t.Errorf("the repo has %v", entries)
+	}
+}
+
+// The old version stays if the databases that would replace it can't be
+// written, because they still refer to it.
+func TestLocalRepoAddFailed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	repo := NewLocalRepo(path.Join(dir, "maw"))
+
+	oldpath := writeRepoTestPkg(t, dir, "foo", "1.0-1")
+	if _, err := repo.Add(NewCanceler(), []string{oldpath}); err != nil {
+		t.Fatalf("Add: %s", err)
+	}
+	if err := os.Mkdir(partialPath(repo.dbPath("files")), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	newpath := writeRepoTestPkg(t, dir, "foo", "1.1-1")
+	if _, err := repo.Add(NewCanceler(), []string{newpath}); err == nil {
+		t.Fatalf("Add succeeded without a .files database")
+	}
+
+	if _, err := os.Stat(path.Join(repo.dir, path.Base(oldpath))); err != nil {
+		t.Errorf("the old version was removed: %s", err)
+	}
+	entries, err := repo.readEntries()
+	if err != nil {
+		t.Fatalf("readEntries: %s", err)
+	}
+	if entries["foo"] == nil || entries["foo"].dirname != "foo-1.0-1" {
+		t.Errorf("the repo has %v", entries)
+	}
+}
@@ -8,7 +8,8 @@ package main
 import (
 	"os"
 	"fmt"
-	"exec"
+	"sync"
+	"strings"
 	"strconv"
 )
 
@@ -16,7 +17,6 @@ type CmdOpt int
 
 const (
 	MAW_USERAGENT = "maw/1.0"
-	MAW_ENVVAR    = " MAWSECRET " // spaces are there so PKGBUILDs can't use it [easily]
 )
 
 const (
@@ -24,60 +24,53 @@ const (
 	OptRemove
 	OptSync
 	OptDepTest
+	OptDatabase
+	OptClean
+	OptList
 	OptHelp
 )
 
 type MawOpt struct {
-	Action  CmdOpt
-	AsDeps  bool
-	Targets []string
+	Action     CmdOpt
+	AsDeps     bool
+	AsExplicit bool
+	Partial    bool // install whatever was fetched, even if some targets failed
+	Strict     bool // refuse to build AUR packages with security issues
+	Prune      CachePrune
+	RepoDir    string            // add built packages to the local repo in this dir
+	Chroot     string            // build AUR packages in clean chroots kept in this dir
+	BuildUser  string            // run builds as this user instead of SUDO_USER or the default
+	Escalate   string            // run pacman as root with this command, if we aren't root
+	CmdPaths   map[string]string // paths of the programs we run, by name
+	Targets    []string
 }
 
 func (mopt *MawOpt) trimDepSpecs() {
-TargetLoop:
 	for i, targ := range mopt.Targets {
-		for idx, ch := range targ {
-			switch ch {
-			case '<', '>', '=':
-				mopt.Targets[i] = targ[:idx]
-				continue TargetLoop
-			}
-		}
+		mopt.Targets[i] = trimDepSpec(targ)
 	}
 }
 
-// This is used by other files, like in srcpkg.go and aur.go.
-// Kind of awkward placement but oh well...
-func lookupSudoUser() (uid, gid int) {
-	uidstr := os.Getenv("SUDO_UID")
-	if uidstr == "" {
-		return
-	}
-	gidstr := os.Getenv("SUDO_GID")
-	if gidstr == "" {
-		return
-	}
-
-	var err os.Error
-	uid, err = strconv.Atoi(uidstr)
-	if err != nil {
-		return
+// trimDepSpec returns the package name of a dependency spec like "foo>=1.0".
+func trimDepSpec(dep string) string {
+	if idx := strings.IndexAny(dep, "<>="); idx != -1 {
+		return dep[:idx]
 	}
-	gid, err = strconv.Atoi(gidstr)
-	if err != nil {
-		uid = 0
-		return
-	}
-	return
+	return dep
 }
 
-func ParseOpts(cmdopts []string) *MawOpt {
+// ParseOpts parses our command line. Options that make no sense together are
+// an error, anything else we don't understand gets the help.
+func ParseOpts(cmdopts []string) (*MawOpt, os.Error) {
 	if len(cmdopts) == 0 {
-		return &MawOpt{Action: OptHelp}
+		return &MawOpt{Action: OptHelp}, nil
 	}
 
 	var act CmdOpt
-	var asdeps bool
+	var asdeps, asexplicit, partial, strict bool
+	var prune CachePrune
+	var repodir, chrootdir, builduser, escalate string
+	cmdpaths := make(map[string]string)
 
 	switch cmdopts[0] {
 	case "-Qq":
@@ -88,6 +81,12 @@ func ParseOpts(cmdopts []string) *MawOpt {
 		act = OptSync
 	case "-T":
 		act = OptDepTest
+	case "-D":
+		act = OptDatabase
+	case "-Sc":
+		act = OptClean
+	case "-Qlp":
+		act = OptList
 	default:
 		act = OptHelp
 	}
@@ -99,60 +98,115 @@ func ParseOpts(cmdopts []string) *MawOpt {
 			targets = append(targets, opt)
 		} else if opt == "--asdeps" {
 			asdeps = true
+		} else if opt == "--asexplicit" {
+			asexplicit = true
+		} else if opt == "--partial" {
+			partial = true
+		} else if opt == "--strict" {
+			strict = true
+		} else if opt == "--uninstalled" {
+			prune.Uninstalled = true
+		} else if strings.HasPrefix(opt, "--older-than=") {
+			days, err := strconv.Atoi(opt[len("--older-than="):])
+			if err != nil || days < 1 {
+				return &MawOpt{Action: OptHelp}, nil
+			}
+			prune.MaxAge = int64(days) * 24 * 60 * 60
+		} else if strings.HasPrefix(opt, "--chroot=") {
+			chrootdir = opt[len("--chroot="):]
+		} else if strings.HasPrefix(opt, "--builduser=") {
+			builduser = opt[len("--builduser="):]
+		} else if strings.HasPrefix(opt, "--pacman=") {
+			cmdpaths["pacman"] = opt[len("--pacman="):]
+		} else if strings.HasPrefix(opt, "--makepkg=") {
+			cmdpaths["makepkg"] = opt[len("--makepkg="):]
+		} else if strings.HasPrefix(opt, "--escalate=") {
+			escalate = opt[len("--escalate="):]
+		} else if strings.HasPrefix(opt, "--localrepo=") {
+			repodir = opt[len("--localrepo="):]
+		} else if strings.HasPrefix(opt, "--keep=") {
+			keep, err := strconv.Atoi(opt[len("--keep="):])
+			if err != nil || keep < 1 {
+				return &MawOpt{Action: OptHelp}, nil
+			}
+			prune.Keep = keep
 		}
 	}
 
-	return &MawOpt{act, asdeps, targets}
+	if asdeps && asexplicit {
+		return nil, os.NewError("--asdeps and --asexplicit can't be used together")
+	}
+
+	return &MawOpt{act, asdeps, asexplicit, partial, strict, prune, repodir, chrootdir,
+		builduser, escalate, cmdpaths, targets}, nil
 }
 
-func runPacman(flag string, args ...string) (int, os.Error) {
-	procargs := make([]string, 2, len(args)+2)
-	procargs[0] = "pacman"
-	procargs[1] = flag
-	procargs = append(procargs, args...)
+// runPacman runs pacman with the operation flag and args. Operations that need
+// root are run through esc.
+func runPacman(cn *Canceler, esc *Escalator, flag string, args ...string) (int, os.Error) {
+	cmd := &Command{Name: "pacman", Args: append([]string{flag}, args...)}
+	if esc.Needed(flag) {
+		cmd = esc.Wrap(cmd)
+	}
 
-	cmd, err := exec.Run("/usr/bin/pacman", procargs, nil, "",
-		exec.PassThrough, exec.PassThrough, exec.PassThrough)
+	result, err := CmdRunner.Run(cn, cmd)
 	if err != nil {
 		return 0, err
 	}
+	return result.ExitStatus, nil
+}
+
+func runDepTest(cn *Canceler, opt *MawOpt) int {
+	if len(opt.Targets) == 0 {
+		return 0
+	}
 
-	waitstatus, err := cmd.Process.Wait(0)
+	code, err := runPacman(cn, nil, "-T", opt.Targets...)
 	if err != nil {
-		return 0, err
+		fmt.Printf("error: %s\n", err.String())
+		return 1
 	}
 
-	return waitstatus.ExitStatus(), nil
+	return code
 }
 
-func runDepTest(opt *MawOpt) int {
+func runRemove(cn *Canceler, esc *Escalator, opt *MawOpt) int {
 	if len(opt.Targets) == 0 {
-		return 0
+		fmt.Printf("error: no targets specified (use -h for help)\n")
+		return 1
 	}
 
-	code, err := runPacman("-T", opt.Targets...)
+	code, err := runPacman(cn, esc, "-Rns", opt.Targets...)
 	if err != nil {
 		fmt.Printf("error: %s\n", err.String())
 		return 1
 	}
-
 	return code
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 // SYNCING
 
-func installPkgFiles(pkgpaths []string, asdeps bool) int {
-	var args []string
-	if asdeps {
-		args = make([]string, 1, len(pkgpaths)+1)
-		args[0] = "--asdeps"
-		args = append(args, pkgpaths...)
-	} else {
-		args = pkgpaths
+// reasonFlag returns pacman's flag for the install reason the options ask for,
+// or "" if they don't.
+func (mopt *MawOpt) reasonFlag() string {
+	switch {
+	case mopt.AsDeps:
+		return "--asdeps"
+	case mopt.AsExplicit:
+		return "--asexplicit"
 	}
+	return ""
+}
 
-	code, err := runPacman("-U", pkgpaths...)
+func installPkgFiles(cn *Canceler, esc *Escalator, pkgpaths []string, reason string) int {
+	args := make([]string, 0, len(pkgpaths)+1)
+	if reason != "" {
+		args = append(args, reason)
+	}
+	args = append(args, pkgpaths...)
+
+	code, err := runPacman(cn, esc, "-U", args...)
 	if err != nil {
 		fmt.Printf("error: %s\n", err.String())
 		return 1
@@ -161,40 +215,429 @@ func installPkgFiles(pkgpaths []string, asdeps bool) int {
 	return code
 }
 
-func runSyncInstall(opt *MawOpt) int {
+// runSetReason changes the install reason of installed packages, like
+// pacman -D does.
+func runSetReason(cn *Canceler, esc *Escalator, opt *MawOpt) int {
+	reason := opt.reasonFlag()
+	if reason == "" {
+		fmt.Printf("error: no install reason specified (use -h for help)\n")
+		return 1
+	}
+	if len(opt.Targets) == 0 {
+		fmt.Printf("error: no targets specified (use -h for help)\n")
+		return 1
+	}
+
+	args := append([]string{reason}, opt.Targets...)
+	code, err := runPacman(cn, esc, "-D", args...)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.String())
+		return 1
+	}
+	return code
+}
+
+func runSyncInstall(cn *Canceler, opt *MawOpt) int {
 	if len(opt.Targets) == 0 {
 		fmt.Printf("error: no targets specified (use -h for help)\n")
 		return 0
 	}
 
-	builder := &PackageBuilder{}
-	aurCache := NewAURCache("/tmp", ".", builder)
-	multifetch := NewMultiFetcher(&PacmanFetcher{"/tmp"}, aurCache)
+	// Without pacman.conf we can still download from the mirror pacman picks.
+	pacconf, err := ReadPacmanConf(PacmanConfPath)
+	if err != nil {
+		fmt.Printf("warning: %s\n", err.String())
+	}
+
+	policy := PolicyWarn
+	if opt.Strict {
+		policy = PolicyRefuse
+	}
+	// Setting up and entering the chroots is not something we can escalate
+	// piecemeal like pacman.
+	if opt.Chroot != "" && os.Getuid() != 0 {
+		fmt.Printf("error: --chroot needs root, run maw as root or with sudo\n")
+		return 1
+	}
+
+	esc, err := NewEscalator(opt.Escalate)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.String())
+		return 1
+	}
+	// Get the password prompt over with before we spend ages building.
+	if err = esc.Authenticate(cn); err != nil {
+		fmt.Printf("error: %s\n", err.String())
+		return 1
+	}
+	defer esc.Stop()
+
+	builduser, err := FindBuildUser(cn, opt.BuildUser, true)
+	if err != nil {
+		fmt.Printf("error: build user: %s\n", err.String())
+		return 1
+	}
+	srcdest, buildroot, err := builduser.AURCacheDirs(true)
+	if err != nil {
+		fmt.Printf("error: %s\n", err.String())
+		return 1
+	}
 
-	pkgpaths, err := multifetch.FetchAll(opt.Targets)
+	// Build deps are fetched like targets are, once multifetch exists.
+	var multifetch *MultiFetcher
+	var builder Builder = NewPackageBuilder(builduser, depInstaller(esc, &multifetch))
+	if opt.Chroot != "" {
+		builder = NewChrootBuilder(opt.Chroot, CacheDirs(pacconf)[0])
+	}
+	aurCache := NewAURCache(srcdest, buildroot, builder, policy)
+	aurCache.GiveFilesTo(builduser)
+	aurCache.UseLocalDB(OpenLocalDB(pacconf))
+	if opt.RepoDir != "" {
+		aurCache.UseLocalRepo(NewLocalRepo(opt.RepoDir))
+	}
+	pacfetch, err := NewPacmanFetcher(pacconf)
 	if err != nil {
 		fmt.Printf("error: %s\n", err.String())
 		return 1
 	}
+	multifetch = NewMultiFetcher(pacfetch, aurCache)
+	for _, cachedir := range CacheDirs(pacconf) {
+		removeStalePartials(cachedir)
+	}
+	removeStalePartials(srcdest)
+
+	pkgpaths, err := multifetch.FetchAll(cn, opt.Targets)
+	if cn.Canceled() {
+		return cn.ExitStatus()
+	}
+	if err != nil {
+		// A MultiFetchError has a line for each failed target.
+		for _, line := range strings.Split(err.String(), "\n") {
+			fmt.Printf("error: %s\n", line)
+		}
+		if !opt.Partial || len(pkgpaths) == 0 {
+			return 1
+		}
+		fmt.Printf("warning: installing the %d packages that were fetched\n",
+			len(pkgpaths))
+	}
+
+	if !checkFileConflicts(cn, pacconf, pkgpaths, aurCache.BuiltPkg) {
+		return 1
+	}
+	return installPkgFiles(cn, esc, pkgpaths, opt.reasonFlag())
+}
+
+// pendingDep is a dependency some build is fetching and installing. done is
+// closed once err is set.
+type pendingDep struct {
+	done       chan bool
+	err        FetchError
+	requesters []string // the pkgnames of the builds waiting for it
+}
+
+// depInstalls keeps track of the deps that are being installed for builds, so
+// that concurrent builds needing the same dep wait for one install of it.
+type depInstalls struct {
+	lock    sync.Mutex
+	pending map[string]*pendingDep
+}
+
+func newDepInstalls() *depInstalls {
+	return &depInstalls{pending: make(map[string]*pendingDep)}
+}
+
+// onChain returns true if name is one of pkgnames, or one of the packages
+// whose builds wait for them, directly or not. A build of pkgnames that waited
+// for name would then wait for itself. di.lock must be held.
+func (di *depInstalls) onChain(pkgnames []string, name string) bool {
+	seen := make(map[string]bool)
+	queue := append([]string{}, pkgnames...)
+	for len(queue) > 0 {
+		pkgname := queue[0]
+		queue = queue[1:]
+		if pkgname == name {
+			return true
+		}
+		if seen[pkgname] {
+			continue
+		}
+		seen[pkgname] = true
+		if dep, ok := di.pending[pkgname]; ok {
+			queue = append(queue, dep.requesters...)
+		}
+	}
+	return false
+}
+
+// start makes the build of pkgnames wait for the deps in names. It returns the
+// deps nobody was installing yet, which the caller must install and finish,
+// and every dep in names to wait for. A dep on the build's dependency chain is
+// a cycle and an error.
+func (di *depInstalls) start(pkgnames, names []string) (mine []string,
+	waiting map[string]*pendingDep, err os.Error) {
+	di.lock.Lock()
+	defer di.lock.Unlock()
+
+	for _, name := range names {
+		if di.onChain(pkgnames, name) {
+			return nil, nil, os.NewError(fmt.Sprintf("dependency cycle: %s depends on %s, "+
+				"which depends on it", strings.Join(pkgnames, " "), name))
+		}
+	}
+	waiting = make(map[string]*pendingDep)
+	for _, name := range names {
+		dep, ok := di.pending[name]
+		if ok {
+			dep.requesters = append(dep.requesters, pkgnames...)
+		} else {
+			dep = &pendingDep{done: make(chan bool),
+				requesters: append([]string{}, pkgnames...)}
+			di.pending[name] = dep
+			mine = append(mine, name)
+		}
+		waiting[name] = dep
+	}
+	return mine, waiting, nil
+}
+
+// finish ends the install of the dep name that start returned as ours, and
+// wakes up everyone waiting for it.
+func (di *depInstalls) finish(name string, err FetchError) {
+	di.lock.Lock()
+	dep := di.pending[name]
+	di.pending[name] = nil, false
+	di.lock.Unlock()
+
+	dep.err = err
+	close(dep.done)
+}
+
+// depInstaller returns a DepInstaller which fetches the missing deps with the
+// MultiFetcher *fetcher points to and installs them, as dependencies, through
+// esc. Each dep is installed as soon as it is fetched, since building one may
+// need another. Builds run concurrently, so installs are done one at a time,
+// and a dep that another build is already installing is waited for instead of
+// fetched twice.
+func depInstaller(esc *Escalator, fetcher **MultiFetcher) DepInstaller {
+	var lock sync.Mutex
+	installs := newDepInstalls()
+
+	return func(cn *Canceler, pkgnames, deps []string) os.Error {
+		missing, err := missingDeps(cn, deps)
+		if err != nil || len(missing) == 0 {
+			return err
+		}
+		for i, dep := range missing {
+			missing[i] = trimDepSpec(dep)
+		}
+
+		mine, waiting, err := installs.start(pkgnames, missing)
+		if err != nil {
+			return err
+		}
+		if len(mine) > 0 {
+			fmt.Printf(":: Installing dependencies: %s\n", strings.Join(mine, " "))
+		}
+		for _, name := range mine {
+			go func(name string) {
+				installs.finish(name, fetchAndInstallDep(cn, esc, *fetcher, name, &lock))
+			}(name)
+		}
+
+		failures := &MultiFetchError{}
+		for _, name := range missing {
+			dep, ok := waiting[name]
+			if !ok {
+				continue // the same name twice
+			}
+			<-dep.done
+			if dep.err != nil {
+				failures.add(name, dep.err)
+			}
+			waiting[name] = nil, false
+		}
+		if len(failures.Targets) > 0 {
+			return failures
+		}
+		return nil
+	}
+}
+
+// fetchAndInstallDep fetches the package named name and installs it as a
+// dependency, holding lock while pacman runs.
+func fetchAndInstallDep(cn *Canceler, esc *Escalator, fetcher *MultiFetcher, name string,
+	lock *sync.Mutex) FetchError {
+	pkgpaths, err := fetcher.Fetch(cn, name)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if code := installPkgFiles(cn, esc, pkgpaths, "--asdeps"); code != 0 {
+		return NewFetchError(name, "failed to install "+name)
+	}
+	return nil
+}
+
+// missingDeps returns the specs in deps that no installed package satisfies,
+// according to pacman -T.
+func missingDeps(cn *Canceler, deps []string) ([]string, os.Error) {
+	cmd := &Command{Name: "pacman", Args: append([]string{"-T"}, deps...), Capture: true}
+	result, err := CmdRunner.Run(cn, cmd)
+	if err != nil {
+		return nil, err
+	}
+	// pacman -T exits with 127 if anything is missing.
+	if result.ExitStatus != 127 {
+		return nil, result.Err(cmd)
+	}
+
+	missing := make([]string, 0, len(deps))
+	for _, line := range strings.Split(string(result.Stdout), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			missing = append(missing, line)
+		}
+	}
+	return missing, nil
+}
+
+// checkFileConflicts checks that the package files at pkgpaths can be installed
+// without overwriting files that belong to other packages, so that we don't
+// leave it to pacman -U to fail. Every conflict is printed. Packages that built
+// returns are not read again; the others are read with ReadBinPkg.
+func checkFileConflicts(cn *Canceler, pacconf *PacmanConf, pkgpaths []string,
+	built func(pkgpath string) *BinPkg) bool {
+	pkgs := make([]*BinPkg, len(pkgpaths))
+	for i, pkgpath := range pkgpaths {
+		if pkgs[i] = built(pkgpath); pkgs[i] != nil {
+			continue
+		}
+		pkg, err := ReadBinPkg(cn, pkgpath)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.String())
+			return false
+		}
+		pkgs[i] = pkg
+	}
+
+	// Without the local DB we can still check the packages against each other.
+	owners, err := OpenLocalDB(pacconf).FileOwners()
+	if err != nil {
+		fmt.Printf("warning: can't check for conflicts with installed packages: %s\n",
+			err.String())
+		owners = nil
+	}
+	root := "/"
+	if pacconf != nil && pacconf.Options.Get("RootDir") != "" {
+		root = pacconf.Options.Get("RootDir")
+	}
+
+	conflicts := FindFileConflicts(pkgs, owners, root)
+	for _, conflict := range conflicts {
+		fmt.Printf("error: %s\n", conflict.String())
+	}
+	if len(conflicts) > 0 {
+		fmt.Printf("error: not installing, %d conflicting files\n", len(conflicts))
+		return false
+	}
+	return true
+}
+
+// runListFiles prints the files in the package files given as targets.
+func runListFiles(cn *Canceler, opt *MawOpt) int {
+	if len(opt.Targets) == 0 {
+		fmt.Printf("error: no targets specified (use -h for help)\n")
+		return 1
+	}
+
+	retcode := 0
+	for _, pkgpath := range opt.Targets {
+		pkg, err := ReadBinPkg(cn, pkgpath)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.String())
+			retcode = 1
+			continue
+		}
+		printFileList(pkg)
+	}
+	return retcode
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CACHE CLEANING
+
+func runCacheClean(cn *Canceler, opt *MawOpt) int {
+	pacconf, err := ReadPacmanConf(PacmanConfPath)
+	if err != nil {
+		fmt.Printf("warning: %s\n", err.String())
+	}
 
-	return installPkgFiles(pkgpaths, opt.AsDeps)
+	var installed map[string]string
+	if opt.Prune.Uninstalled {
+		installed, err = OpenLocalDB(pacconf).Installed()
+		if err != nil {
+			fmt.Printf("error: %s\n", err.String())
+			return 1
+		}
+	}
+
+	// Only look in the build user's cache dirs, without creating anything.
+	builduser, err := FindBuildUser(cn, opt.BuildUser, false)
+	if err != nil {
+		fmt.Printf("error: build user: %s\n", err.String())
+		return 1
+	}
+	srcdest, buildroot, _ := builduser.AURCacheDirs(false)
+	aurCache := NewAURCache(srcdest, buildroot, nil, PolicyWarn)
+	if err := aurCache.CleanCache(&opt.Prune, installed); err != nil {
+		fmt.Printf("error: %s\n", err.String())
+		return 1
+	}
+	return 0
 }
 
 func main() {
-	opt := ParseOpts(os.Args[1:])
+	opt, err := ParseOpts(os.Args[1:])
+	if err != nil {
+		fmt.Printf("error: %s\n", err.String())
+		os.Exit(1)
+	}
+	CmdRunner = NewExecRunner(opt.CmdPaths)
+
+	cn := NewCanceler()
+	go cn.HandleSignals()
 
+	var retcode int
 	switch opt.Action {
 	case OptHelp:
 		fmt.Printf("Help help I'm being repressed!\nBloody peasants!\n")
-		os.Exit(0)
 	case OptDepTest:
-		retcode := runDepTest(opt)
-		os.Exit(retcode)
+		retcode = runDepTest(cn, opt)
+	case OptRemove, OptDatabase:
+		esc, err := NewEscalator(opt.Escalate)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.String())
+			retcode = 1
+		} else if opt.Action == OptRemove {
+			retcode = runRemove(cn, esc, opt)
+		} else {
+			retcode = runSetReason(cn, esc, opt)
+		}
 	case OptSync:
 		opt.trimDepSpecs()
-		retcode := runSyncInstall(opt)
-		os.Exit(retcode)
+		retcode = runSyncInstall(cn, opt)
+	case OptClean:
+		retcode = runCacheClean(cn, opt)
+	case OptList:
+		retcode = runListFiles(cn, opt)
 	}
 
-	os.Exit(0)
+	// Remove partial downloads left behind if we were interrupted.
+	cn.Cleanup()
+	if cn.Canceled() {
+		os.Exit(cn.ExitStatus())
+	}
+	os.Exit(retcode)
 }
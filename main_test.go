@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseOptsReason(t *testing.T) {
+	opt, err := ParseOpts([]string{"-D", "--asdeps", "foo"})
+	if err != nil {
+		t.Fatalf("ParseOpts: %s", err)
+	}
+	if opt.Action != OptDatabase || opt.reasonFlag() != "--asdeps" ||
+		strings.Join(opt.Targets, " ") != "foo" {
+		t.Errorf("got action %d, reason %q, targets %v", opt.Action, opt.reasonFlag(),
+			opt.Targets)
+	}
+
+	for _, cmdline := range [][]string{{"-D", "--asdeps", "--asexplicit", "foo"},
+		{"-S", "--asexplicit", "foo", "--asdeps"}} {
+		if opt, err := ParseOpts(cmdline); err == nil {
+			t.Errorf("ParseOpts(%v) = %v, want an error", cmdline, opt)
+		}
+	}
+}
+
+func TestInstallAsDeps(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+
+	pkgpaths := []string{"/cache/foo-1.0-1-x86_64.pkg.tar.zst", "/cache/bar-2.0-1-any.pkg.tar.zst"}
+	if code := installPkgFiles(NewCanceler(), testEscalator(), pkgpaths, "--asdeps"); code != 0 {
+		t.Errorf("exit status %d", code)
+	}
+	checkRan(t, fake, "/usr/bin/sudo pacman -U --asdeps "+strings.Join(pkgpaths, " "))
+}
+
+func TestSetReason(t *testing.T) {
+	tests := []struct {
+		cmdline []string
+		want    string
+	}{
+		{[]string{"-D", "--asdeps", "foo", "bar"}, "/usr/bin/sudo pacman -D --asdeps foo bar"},
+		{[]string{"-D", "--asexplicit", "foo"}, "/usr/bin/sudo pacman -D --asexplicit foo"},
+	}
+	for _, test := range tests {
+		fake, restore := useFakeRunner()
+		opt, err := ParseOpts(test.cmdline)
+		if err != nil {
+			t.Fatalf("ParseOpts(%v): %s", test.cmdline, err)
+		}
+		if code := runSetReason(NewCanceler(), testEscalator(), opt); code != 0 {
+			t.Errorf("%v: exit status %d", test.cmdline, code)
+		}
+		checkRan(t, fake, test.want)
+		restore()
+	}
+}
+
+// Without a reason there is nothing to do, pacman -D isn't run.
+func TestSetReasonMissing(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+
+	opt, _ := ParseOpts([]string{"-D", "foo"})
+	if code := runSetReason(NewCanceler(), testEscalator(), opt); code == 0 {
+		t.Errorf("-D without a reason succeeded")
+	}
+	checkRan(t, fake)
+}
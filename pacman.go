@@ -6,82 +6,223 @@ package main
 
 import (
 	"os"
-	"io"
-	"bufio"
-	"exec"
 	"path"
+	"fmt"
 	"http"
 	"strings"
+	"strconv"
 )
 
 type PacmanFetcher struct {
-	pkgdest string
+	pkgdest   string      // where new package files are downloaded to
+	cachedirs []string    // where to look for package files we already have
+	conf      *PacmanConf // for mirror lists, may be nil
+	verifier  *SigVerifier
 }
 
-func (pf *PacmanFetcher) readLine(readhandle io.Reader) string {
-	buf := bufio.NewReader(readhandle)
-	line, _, _ := buf.ReadLine()
-	return string(line)
-}
-
-func (pf *PacmanFetcher) findPackageUrl(pkgname string) (string, FetchError) {
-	args := []string{"pacman", "-S", "--print", pkgname}
-	cmd, err := exec.Run("/usr/bin/pacman", args, nil, "",
-		exec.DevNull, exec.Pipe, exec.Pipe)
-	if err != nil {
-		return "", FetchErrorWrap(pkgname, err)
+// NewPacmanFetcher creates a PacmanFetcher which uses pacman's package cache
+// dirs. Package files already in one of the cache dirs are used if they pass
+// verification, new package files are downloaded into the first, or into the
+// UserCacheDir if we aren't root. Signatures are checked against the keyring in
+// pacman's GPGDir.
+func NewPacmanFetcher(conf *PacmanConf) (*PacmanFetcher, os.Error) {
+	cachedirs := CacheDirs(conf)
+	pkgdest := cachedirs[0]
+	if os.Getuid() != 0 {
+		var err os.Error
+		if pkgdest, err = UserCacheDir(); err != nil {
+			return nil, err
+		}
+		cachedirs = append([]string{pkgdest}, cachedirs...)
 	}
-	defer cmd.Close()
+	return &PacmanFetcher{pkgdest, cachedirs, conf,
+		NewSigVerifier(KeyringPath(conf))}, nil
+}
 
-	waitmsg, err := cmd.Wait(0)
+// findPackageUrl asks pacman for the repo and download URL of pkgname.
+func (pf *PacmanFetcher) findPackageUrl(cn *Canceler, pkgname string) (string, string, FetchError) {
+	cmd := &Command{Name: "pacman",
+		Args:    []string{"-S", "--print", "--print-format", "%r %l", pkgname},
+		Capture: true, Quiet: true}
+	result, err := CmdRunner.Run(cn, cmd)
 	if err != nil {
-		return "", FetchErrorWrap(pkgname, err)
+		return "", "", FetchErrorWrap(pkgname, err)
 	}
 
-	if code := waitmsg.ExitStatus(); code != 0 {
-		errline := pf.readLine(cmd.Stderr)
+	if result.ExitStatus != 0 {
+		errline := firstLine(result.Stderr)
 		if errline == "error: target not found: "+pkgname {
-			return "", NotFoundError(pkgname)
+			return "", "", NotFoundError(pkgname)
 		}
-		return "", NewFetchError(pkgname, "pacman "+errline)
+		return "", "", NewFetchError(pkgname, "pacman "+errline)
 	}
 
-	url := pf.readLine(cmd.Stdout)
-	return url, nil
+	line := firstLine(result.Stdout)
+	sep := strings.Index(line, " ")
+	if sep == -1 {
+		return "", "", NewFetchError(pkgname, "unexpected pacman output: "+line)
+	}
+	return line[:sep], line[sep+1:], nil
 }
 
-func (pf *PacmanFetcher) Fetch(pkgname string) ([]string, FetchError) {
-	urltext, err := pf.findPackageUrl(pkgname)
+func firstLine(output []byte) string {
+	text := string(output)
+	if idx := strings.Index(text, "\n"); idx != -1 {
+		return text[:idx]
+	}
+	return text
+}
+
+// mirrorUrls returns every URL the package file at urltext can be downloaded
+// from, in order of preference. The URL pacman gave us comes first, followed
+// by the same file on every other Server of the repo.
+func (pf *PacmanFetcher) mirrorUrls(repo, urltext string) []string {
+	urls := []string{urltext}
+	if pf.conf == nil {
+		return urls
+	}
+
+	filename := path.Base(urltext)
+	for _, server := range pf.conf.Servers(repo) {
+		mirrorurl := server + "/" + filename
+		if mirrorurl != urltext {
+			urls = append(urls, mirrorurl)
+		}
+	}
+	return urls
+}
+
+func (pf *PacmanFetcher) Fetch(cn *Canceler, pkgname string) ([]string, FetchError) {
+	repo, urltext, err := pf.findPackageUrl(cn, pkgname)
 	if err != nil {
 		return nil, err
 	}
 
-	url, oserr := http.ParseURL(urltext)
+	// The sync database tells us what the file we download should look like.
+	filename := path.Base(urltext)
+	desc, oserr := OpenSyncDB(pf.conf, repo).FindFile(pkgname, filename)
 	if oserr != nil {
 		return nil, FetchErrorWrap(pkgname, oserr)
 	}
+	if desc == nil {
+		return nil, NewFetchError(pkgname, filename+" is missing from the "+
+			repo+" sync database")
+	}
 
-	var pkgpath string
+	urls := pf.mirrorUrls(repo, urltext)
+	if pkgpath := pf.findCached(cn, repo, desc, urls[0]); pkgpath != "" {
+		return []string{pkgpath}, nil
+	}
 
-	switch url.Scheme {
-	case "http":
-		fallthrough
-	case "https":
-		pkgpath, oserr = pf.httpDownload(url)
-	case "ftp":
-		pkgpath, oserr = pf.ftpDownload(url)
-	default:
-		return nil, NewFetchError(pkgname, "Unrecognized URL scheme: "+url.Scheme)
+	// Try each mirror in turn until one works. A mirror that gives us a bad
+	// package file counts as not working.
+	errmsgs := make([]string, 0, len(urls))
+	for _, mirrorurl := range urls {
+		// The download is checked before it is renamed into the cache,
+		// so that a bad package file never shows up there.
+		verify := func(tmppath string) os.Error {
+			if err := VerifyPkgFile(desc, tmppath); err != nil {
+				return err
+			}
+			return pf.checkSignature(cn, repo, desc, mirrorurl, tmppath)
+		}
+		pkgpath, oserr := pf.download(cn, mirrorurl, verify)
+		if oserr == nil {
+			if len(errmsgs) > 0 {
+				fmt.Printf("%s downloaded from %s\n", pkgname, mirrorurl)
+			}
+			return []string{pkgpath}, nil
+		}
+		if cn.Canceled() {
+			return nil, FetchErrorWrap(pkgname, ErrCanceled)
+		}
+
+		fmt.Printf("warning: failed to download %s from %s: %s\n",
+			pkgname, mirrorurl, oserr.String())
+		errmsgs = append(errmsgs, oserr.String())
 	}
 
-	if oserr != nil {
-		return nil, FetchErrorWrap(pkgname, oserr)
+	msg := fmt.Sprintf("download failed from all %d mirrors", len(urls))
+	if len(errmsgs) == 1 {
+		msg = errmsgs[0]
+	}
+	return nil, NewFetchError(pkgname, msg)
+}
+
+// findCached looks for the package file described by desc in the cache dirs.
+// If a cached file passes verification, its path is returned. Otherwise "" is
+// returned and we have to download it.
+func (pf *PacmanFetcher) findCached(cn *Canceler, repo string, desc PkgDesc, mirrorurl string) string {
+	for _, cachedir := range pf.cachedirs {
+		pkgpath := path.Join(cachedir, desc.Get("FILENAME"))
+		if _, err := os.Stat(pkgpath); err != nil {
+			continue
+		}
+		if err := VerifyPkgFile(desc, pkgpath); err != nil {
+			fmt.Printf("warning: ignoring cached %s: %s\n", pkgpath, err.String())
+			continue
+		}
+		if err := pf.checkSignature(cn, repo, desc, mirrorurl, pkgpath); err != nil {
+			fmt.Printf("warning: ignoring cached %s: %s\n", pkgpath, err.String())
+			continue
+		}
+		return pkgpath
+	}
+	return ""
+}
+
+// checkSignature verifies the signature of the package file at pkgpath, as
+// required by the repo's SigLevel. The signature is taken from the sync
+// database entry if it is there, or from a .sig file next to the package file
+// (pacman keeps these in its cache). Otherwise the .sig file is downloaded from
+// the same mirror as the package.
+func (pf *PacmanFetcher) checkSignature(cn *Canceler, repo string, desc PkgDesc, mirrorurl, pkgpath string) os.Error {
+	level := PackageSigLevel(pf.conf, repo)
+	if level == SigNever {
+		return nil
+	}
+
+	if sig := desc.Get("PGPSIG"); sig != "" {
+		_, err := pf.verifier.VerifyBase64(cn, pkgpath, sig)
+		return err
+	}
+
+	sigpath := pkgpath + ".sig"
+	if _, err := os.Stat(sigpath); err != nil {
+		sigpath, err = pf.download(cn, mirrorurl+".sig", nil)
+		if err != nil {
+			if level == SigOptional && !cn.Canceled() {
+				return nil
+			}
+			return os.NewError("failed to download signature: " + err.String())
+		}
 	}
 
-	return []string{pkgpath}, nil
+	_, err := pf.verifier.VerifyFile(cn, pkgpath, sigpath)
+	if err != nil {
+		os.Remove(sigpath)
+	}
+	return err
+}
+
+// download downloads the package file at urltext into our pkgdest. If verify is
+// not nil, the file is only saved if verify accepts it (see resumeDownload).
+func (pf *PacmanFetcher) download(cn *Canceler, urltext string, verify func(string) os.Error) (string, os.Error) {
+	url, err := http.ParseURL(urltext)
+	if err != nil {
+		return "", err
+	}
+
+	switch url.Scheme {
+	case "http", "https":
+		return pf.httpDownload(cn, url, verify)
+	case "ftp":
+		return pf.ftpDownload(cn, url, verify)
+	}
+	return "", os.NewError("Unrecognized URL scheme: " + url.Scheme)
 }
 
-func (pf *PacmanFetcher) ftpDownload(url *http.URL) (string, os.Error) {
+func (pf *PacmanFetcher) ftpDownload(cn *Canceler, url *http.URL, verify func(string) os.Error) (string, os.Error) {
 	host, rpath := url.Host, url.Path
 	if strings.Index(host, ":") == -1 {
 		host = host + ":21"
@@ -90,36 +231,61 @@ func (pf *PacmanFetcher) ftpDownload(url *http.URL) (string, os.Error) {
 	_, filename := path.Split(rpath)
 	destpath := path.Join(pf.pkgdest, filename)
 
-	ftp, err := DialFtp(host)
+	ftp, err := DialFtp(cn, host)
 	if err != nil {
 		return "", err
 	}
-	rdr, err := ftp.Fetch(rpath)
+	defer ftp.Close()
+
+	// The size is only used to check the download, not every server has SIZE.
+	size, err := ftp.Size(rpath)
 	if err != nil {
-		return "", err
+		size = -1
 	}
-	defer ftp.Close()
 
-	destfile, err := os.Create(destpath)
+	partial, err := lockPartial(destpath)
 	if err != nil {
 		return "", err
 	}
+	defer closePartial(partial)
 
-	_, err = io.Copy(destfile, rdr)
+	offset := resumeOffset(partial)
+	if size >= 0 && offset >= size {
+		// Whatever is there is either complete or garbage, start over.
+		offset = 0
+	}
+	rdr, offset, err := ftp.Fetch(rpath, offset)
 	if err != nil {
 		return "", err
 	}
-	destfile.Close()
 
-	return destpath, nil
+	return resumeDownload(cn, partial, destpath, rdr, offset, size, verify)
 }
 
-func (pf *PacmanFetcher) httpDownload(url *http.URL) (string, os.Error) {
+// httpDownload downloads the package file at url. If part of the file was
+// already downloaded by an earlier attempt, only the rest is requested. Repo
+// package files never change once they are published (the version is in the
+// filename) so we only validate that the server sent us the range we asked for.
+func (pf *PacmanFetcher) httpDownload(cn *Canceler, url *http.URL, verify func(string) os.Error) (string, os.Error) {
+	_, filename := path.Split(url.Path)
+	destpath := path.Join(pf.pkgdest, filename)
+
 	req, err := http.NewRequest("GET", url.String(), nil)
 	if err != nil {
 		return "", err
 	}
 
+	partial, err := lockPartial(destpath)
+	if err != nil {
+		return "", err
+	}
+	defer closePartial(partial)
+
+	offset := resumeOffset(partial)
+	if offset > 0 {
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
 	req.UserAgent = MAW_USERAGENT
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -127,26 +293,67 @@ func (pf *PacmanFetcher) httpDownload(url *http.URL) (string, os.Error) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	var size int64
+	switch resp.StatusCode {
+	case 200:
+		// The server ignored our Range header, we get the whole thing.
+		offset, size = 0, resp.ContentLength
+	case 206:
+		var start int64
+		start, size, err = parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return "", err
+		}
+		if start != offset {
+			os.Remove(partialPath(destpath))
+			return "", os.NewError("Download of " + url.String() +
+				" failed: server sent the wrong range")
+		}
+	case 416:
+		// Our partial file is no good (maybe it is already complete but
+		// never got renamed). Throw it away and try again from scratch.
+		if offset > 0 {
+			os.Remove(partialPath(destpath))
+			return pf.httpDownload(cn, url, verify)
+		}
+		fallthrough
+	default:
 		return "", os.NewError("Download of " + url.String() + " failed: HTTP " + resp.Status)
 	}
 
-	_, filename := path.Split(url.Path)
-	destpath := path.Join(pf.pkgdest, filename)
-	destfile, err := os.Create(destpath)
-	if err != nil {
+	// Closing the body on cancel interrupts resumeDownload.
+	if err = cn.AddCloser(resp.Body); err != nil {
 		return "", err
 	}
-	defer destfile.Close()
+	defer cn.RemoveCloser(resp.Body)
+
+	return resumeDownload(cn, partial, destpath, resp.Body, offset, size, verify)
+}
+
+// parseContentRange parses the value of an HTTP Content-Range header, like
+// "bytes 100-199/200". The first byte position and the complete length are
+// returned. The complete length is -1 if the server doesn't know it ("*").
+func parseContentRange(hdr string) (start, size int64, err os.Error) {
+	var badRange = os.NewError("Invalid Content-Range header: " + hdr)
 
-	if resp.ContentLength < 0 {
-		_, err = io.Copy(destfile, resp.Body)
-	} else {
-		_, err = io.Copyn(destfile, resp.Body, resp.ContentLength)
+	if !strings.HasPrefix(hdr, "bytes ") {
+		return 0, 0, badRange
 	}
-	if err != nil {
-		return "", err
+	spec := strings.TrimSpace(hdr[len("bytes "):])
+	slash := strings.Index(spec, "/")
+	dash := strings.Index(spec, "-")
+	if slash == -1 || dash == -1 || dash > slash {
+		return 0, 0, badRange
 	}
 
-	return destpath, nil
+	if start, err = strconv.Atoi64(spec[:dash]); err != nil {
+		return 0, 0, badRange
+	}
+	if spec[slash+1:] == "*" {
+		return start, -1, nil
+	}
+	if size, err = strconv.Atoi64(spec[slash+1:]); err != nil {
+		return 0, 0, badRange
+	}
+	return start, size, nil
 }
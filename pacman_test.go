@@ -0,0 +1,416 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"http"
+	"path"
+	"strings"
+	"strconv"
+	"testing"
+	"io/ioutil"
+	"archive/tar"
+	"crypto/sha256"
+	"http/httptest"
+	"encoding/hex"
+)
+
+// The package file our test servers serve.
+var testPkgContent = strings.Repeat("maw test package data. ", 100)
+
+const testPkgFilename = "foo-1.0-1-x86_64.pkg.tar.zst"
+
+// rangeServer serves testPkgContent over HTTP. How it answers requests with a
+// Range header depends on mode: "range" honors it, "ignore" sends the whole
+// file with 200, "wrong" sends a range starting at 0 and "416" refuses it.
+type rangeServer struct {
+	*httptest.Server
+	mode   string
+	ranges []string // the Range header of every request, "" for none
+}
+
+func newRangeServer(mode string) *rangeServer {
+	rs := &rangeServer{mode: mode}
+	rs.Server = httptest.NewServer(http.HandlerFunc(rs.serve))
+	return rs
+}
+
+func (rs *rangeServer) serve(w http.ResponseWriter, req *http.Request) {
+	rng := req.Header.Get("Range")
+	rs.ranges = append(rs.ranges, rng)
+	if rng == "" || rs.mode == "ignore" {
+		w.Write([]byte(testPkgContent))
+		return
+	}
+
+	if !strings.HasPrefix(rng, "bytes=") {
+		http.Error(w, "bad range", 400)
+		return
+	}
+	start, err := strconv.Atoi(strings.TrimRight(rng[len("bytes="):], "-"))
+	if err != nil {
+		http.Error(w, "bad range", 400)
+		return
+	}
+	switch rs.mode {
+	case "wrong":
+		start = 0
+	case "416":
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(testPkgContent)))
+		w.WriteHeader(416)
+		return
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start,
+		len(testPkgContent)-1, len(testPkgContent)))
+	w.WriteHeader(206)
+	w.Write([]byte(testPkgContent[start:]))
+}
+
+func (rs *rangeServer) url(t *testing.T) *http.URL {
+	url, err := http.ParseURL(rs.URL + "/core/os/x86_64/" + testPkgFilename)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return url
+}
+
+// writePartial puts a partial download of the test package with the contents
+// data into dir.
+func writePartial(t *testing.T, dir, data string) {
+	destpath := path.Join(dir, testPkgFilename)
+	if err := ioutil.WriteFile(partialPath(destpath), []byte(data), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+// checkDownloaded checks that the test package was downloaded into dir,
+// completely, and that no partial download is left.
+func checkDownloaded(t *testing.T, dir, pkgpath string, err os.Error) {
+	destpath := path.Join(dir, testPkgFilename)
+	if err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+	if pkgpath != destpath {
+		t.Errorf("downloaded to %s, want %s", pkgpath, destpath)
+	}
+	if data, _ := ioutil.ReadFile(destpath); string(data) != testPkgContent {
+		t.Errorf("downloaded %d bytes that aren't the package", len(data))
+	}
+	if _, err := os.Stat(partialPath(destpath)); err == nil {
+		t.Errorf("the partial download was left behind")
+	}
+}
+
+func checkRanges(t *testing.T, rs *rangeServer, want ...string) {
+	if strings.Join(rs.ranges, ",") != strings.Join(want, ",") {
+		t.Errorf("requested ranges %q, want %q", rs.ranges, want)
+	}
+}
+
+func TestHttpDownload(t *testing.T) {
+	rs := newRangeServer("range")
+	defer rs.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	pf := &PacmanFetcher{pkgdest: dir}
+	pkgpath, err := pf.httpDownload(NewCanceler(), rs.url(t), nil)
+	checkDownloaded(t, dir, pkgpath, err)
+	checkRanges(t, rs, "")
+}
+
+func TestHttpDownloadResume(t *testing.T) {
+	rs := newRangeServer("range")
+	defer rs.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writePartial(t, dir, testPkgContent[:400])
+
+	pf := &PacmanFetcher{pkgdest: dir}
+	pkgpath, err := pf.httpDownload(NewCanceler(), rs.url(t), nil)
+	checkDownloaded(t, dir, pkgpath, err)
+	checkRanges(t, rs, "bytes=400-")
+}
+
+// A server that answers a Range request with 200 sends the whole file, which
+// replaces the partial download.
+func TestHttpDownloadRangeIgnored(t *testing.T) {
+	rs := newRangeServer("ignore")
+	defer rs.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writePartial(t, dir, strings.Repeat("x", 400))
+
+	pf := &PacmanFetcher{pkgdest: dir}
+	pkgpath, err := pf.httpDownload(NewCanceler(), rs.url(t), nil)
+	checkDownloaded(t, dir, pkgpath, err)
+	checkRanges(t, rs, "bytes=400-")
+}
+
+// 416 means our partial download is no good; it is thrown away and the whole
+// file is downloaded again.
+func TestHttpDownload416(t *testing.T) {
+	rs := newRangeServer("416")
+	defer rs.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writePartial(t, dir, strings.Repeat("x", len(testPkgContent)))
+
+	pf := &PacmanFetcher{pkgdest: dir}
+	pkgpath, err := pf.httpDownload(NewCanceler(), rs.url(t), nil)
+	checkDownloaded(t, dir, pkgpath, err)
+	checkRanges(t, rs, fmt.Sprintf("bytes=%d-", len(testPkgContent)), "")
+}
+
+func TestHttpDownloadWrongRange(t *testing.T) {
+	rs := newRangeServer("wrong")
+	defer rs.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writePartial(t, dir, testPkgContent[:400])
+
+	pf := &PacmanFetcher{pkgdest: dir}
+	if _, err := pf.httpDownload(NewCanceler(), rs.url(t), nil); err == nil {
+		t.Errorf("download with the wrong range succeeded")
+	}
+	destpath := path.Join(dir, testPkgFilename)
+	if _, err := os.Stat(destpath); err == nil {
+		t.Errorf("a package file was saved")
+	}
+	if _, err := os.Stat(partialPath(destpath)); err == nil {
+		t.Errorf("the partial download was kept")
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		hdr         string
+		start, size int64
+		ok          bool
+	}{
+		{"bytes 100-199/200", 100, 200, true},
+		{"bytes 0-0/1", 0, 1, true},
+		{"bytes 100-199/*", 100, -1, true},
+		{"bytes  5-9/10", 5, 10, true},
+		{"bytes */200", 0, 0, false},
+		{"bytes 100/200", 0, 0, false},
+		{"bytes 100-199", 0, 0, false},
+		{"items 100-199/200", 0, 0, false},
+		{"bytes x-199/200", 0, 0, false},
+		{"bytes 100-199/y", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, size, err := parseContentRange(test.hdr)
+		if (err == nil) != test.ok || start != test.start || size != test.size {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v", test.hdr, start, size, err)
+		}
+	}
+}
+
+// A download that fails verification is neither renamed into place nor kept
+// for resuming.
+func TestHttpDownloadVerify(t *testing.T) {
+	rs := newRangeServer("range")
+	defer rs.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	destpath := path.Join(dir, testPkgFilename)
+
+	var verified string
+	verify := func(tmppath string) os.Error {
+		verified = tmppath
+		if data, _ := ioutil.ReadFile(tmppath); string(data) != testPkgContent {
+			t.Errorf("verifying an incomplete download")
+		}
+		if _, err := os.Stat(destpath); err == nil {
+			t.Errorf("the package file was saved before it was verified")
+		}
+		return os.NewError("bad package")
+	}
+	pf := &PacmanFetcher{pkgdest: dir}
+	if _, err := pf.httpDownload(NewCanceler(), rs.url(t), verify); err == nil {
+		t.Errorf("download that failed verification succeeded")
+	}
+	if verified != partialPath(destpath) {
+		t.Errorf("verified %q, want the partial download", verified)
+	}
+	if names := dirNames(t, dir); len(names) != 0 {
+		t.Errorf("files left after failed verification: %v", names)
+	}
+}
+
+// fetchTest is a PacmanFetcher for the core repo, whose sync database has the
+// test package, and which downloads from the mirrors given. pacman is faked to
+// print the URL of the package on the first mirror.
+type fetchTest struct {
+	dir      string
+	cachedir string
+	pf       *PacmanFetcher
+	fake     *FakeRunner
+	restore  func()
+}
+
+func newFetchTest(t *testing.T, mirrors ...string) *fetchTest {
+	ft := &fetchTest{dir: tempDir(t)}
+	servers := ""
+	for _, mirror := range mirrors {
+		servers += "Server = " + mirror + "/$repo/os/$arch\n"
+	}
+	conf := writePacmanConf(t, ft.dir, "SigLevel = Never\nArchitecture = x86_64\nDBPath = "+
+		path.Join(ft.dir, "db"), servers)
+
+	ft.cachedir = path.Join(ft.dir, "cache")
+	if err := os.MkdirAll(ft.cachedir, 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	writeSyncDB(t, path.Join(ft.dir, "db"), testPkgFilename, []byte(testPkgContent))
+
+	ft.pf = &PacmanFetcher{pkgdest: ft.cachedir, cachedirs: []string{ft.cachedir}, conf: conf}
+	ft.fake, ft.restore = useFakeRunner()
+	ft.fake.Results["pacman -S --print --print-format %r %l foo"] = &CmdResult{
+		Stdout: []byte("core " + mirrors[0] + "/core/os/x86_64/" + testPkgFilename + "\n")}
+	return ft
+}
+
+// writeSyncDB writes the core sync database to dbpath, with the package foo
+// 1.0-1 in it. The package file is named filename and has the contents data.
+func writeSyncDB(t *testing.T, dbpath, filename string, data []byte) {
+	hash := sha256.New()
+	hash.Write(data)
+	desc := fmt.Sprintf("%%FILENAME%%\n%s\n\n%%NAME%%\nfoo\n\n%%CSIZE%%\n%d\n\n"+
+		"%%SHA256SUM%%\n%s\n\n", filename, len(data), hex.EncodeToString(hash.Sum()))
+	if err := os.MkdirAll(path.Join(dbpath, "sync"), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	writeTarball(t, path.Join(dbpath, "sync/core.db"), []tarEntry{
+		{Name: "foo-1.0-1/", Typeflag: tar.TypeDir},
+		{Name: "foo-1.0-1/desc", Body: desc}})
+}
+
+func (ft *fetchTest) close() {
+	ft.restore()
+	os.RemoveAll(ft.dir)
+}
+
+// downMirror returns the URL of a mirror that refuses connections.
+func downMirror() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+// badPkgServer serves package files that aren't the test package.
+func badPkgServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(strings.Repeat("x", len(testPkgContent))))
+	}))
+}
+
+// Mirrors that are down, don't have the package or give us a bad one are
+// skipped.
+func TestFetchMirrorFailover(t *testing.T) {
+	notfound := httptest.NewServer(http.NotFoundHandler())
+	defer notfound.Close()
+	bad := badPkgServer()
+	defer bad.Close()
+	good := newRangeServer("range")
+	defer good.Close()
+	ft := newFetchTest(t, downMirror(), notfound.URL, bad.URL, good.URL)
+	defer ft.close()
+
+	pkgpaths, err := ft.pf.Fetch(NewCanceler(), "foo")
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if len(pkgpaths) != 1 {
+		t.Fatalf("Fetch returned %v", pkgpaths)
+	}
+	checkDownloaded(t, ft.cachedir, pkgpaths[0], nil)
+	checkRanges(t, good, "")
+	if names := dirNames(t, ft.cachedir); len(names) != 1 {
+		t.Errorf("the cache has %v", names)
+	}
+}
+
+func TestFetchAllMirrorsFail(t *testing.T) {
+	notfound := httptest.NewServer(http.NotFoundHandler())
+	defer notfound.Close()
+	bad := badPkgServer()
+	defer bad.Close()
+	ft := newFetchTest(t, notfound.URL, bad.URL)
+	defer ft.close()
+
+	_, err := ft.pf.Fetch(NewCanceler(), "foo")
+	if err == nil || !strings.Contains(err.String(), "all 2 mirrors") {
+		t.Errorf("Fetch returned %v, want failed from all mirrors", err)
+	}
+	if names := dirNames(t, ft.cachedir); len(names) != 0 {
+		t.Errorf("the cache has %v", names)
+	}
+}
+
+// A package file already in one of pacman's cache dirs isn't downloaded again.
+func TestFetchCached(t *testing.T) {
+	rs := newRangeServer("range")
+	defer rs.Close()
+	ft := newFetchTest(t, rs.URL)
+	defer ft.close()
+	pacmancache := path.Join(ft.dir, "pacman-cache")
+	writeCacheFiles(t, pacmancache, map[string]string{testPkgFilename: testPkgContent})
+	ft.pf.cachedirs = append(ft.pf.cachedirs, pacmancache)
+
+	pkgpaths, err := ft.pf.Fetch(NewCanceler(), "foo")
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if len(pkgpaths) != 1 || pkgpaths[0] != path.Join(pacmancache, testPkgFilename) {
+		t.Errorf("Fetch returned %v, want the cached file", pkgpaths)
+	}
+	checkRanges(t, rs)
+}
+
+// A cached package file that doesn't match the sync database is left alone,
+// and the package is downloaded.
+func TestFetchCachedBad(t *testing.T) {
+	rs := newRangeServer("range")
+	defer rs.Close()
+	ft := newFetchTest(t, rs.URL)
+	defer ft.close()
+	pacmancache := path.Join(ft.dir, "pacman-cache")
+	writeCacheFiles(t, pacmancache, map[string]string{testPkgFilename: "corrupt"})
+	ft.pf.cachedirs = append(ft.pf.cachedirs, pacmancache)
+
+	pkgpaths, err := ft.pf.Fetch(NewCanceler(), "foo")
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if len(pkgpaths) != 1 {
+		t.Fatalf("Fetch returned %v", pkgpaths)
+	}
+	checkDownloaded(t, ft.cachedir, pkgpaths[0], nil)
+	checkRanges(t, rs, "")
+	if data, _ := ioutil.ReadFile(path.Join(pacmancache, testPkgFilename)); string(data) != "corrupt" {
+		t.Errorf("the bad cached file was changed")
+	}
+}
+
+func TestCacheDirs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct{ options, want string }{
+		{"", DefaultCacheDir},
+		{"CacheDir = /srv/pkg", "/srv/pkg"},
+		{"CacheDir = /srv/pkg\nCacheDir = /var/cache/pacman/pkg", "/srv/pkg /var/cache/pacman/pkg"},
+	}
+	for _, test := range tests {
+		conf := writePacmanConf(t, dir, test.options, "")
+		if got := strings.Join(CacheDirs(conf), " "); got != test.want {
+			t.Errorf("%q: CacheDirs = %q, want %q", test.options, got, test.want)
+		}
+	}
+	if got := strings.Join(CacheDirs(nil), " "); got != DefaultCacheDir {
+		t.Errorf("CacheDirs without pacman.conf = %q", got)
+	}
+}
@@ -0,0 +1,220 @@
+/*	pacmanconf.go
+	Reading pacman's configuration file, /etc/pacman.conf.
+*/
+
+package main
+
+import (
+	"os"
+	"path"
+	"bufio"
+	"strings"
+	"syscall"
+)
+
+const (
+	DefaultCacheDir = "/var/cache/pacman/pkg/"
+)
+
+// The pacman.conf we read. Tests use their own.
+var PacmanConfPath = "/etc/pacman.conf"
+
+// PacmanSection holds the settings of one [section] of pacman.conf. Every
+// value of a key is kept, in order, because keys like Server may repeat.
+type PacmanSection struct {
+	Name   string
+	values map[string][]string
+}
+
+// PacmanConf is a parsed pacman.conf. Options is the [options] section, Repos
+// holds every other section in the order they appear, which is the order
+// pacman searches them in.
+type PacmanConf struct {
+	Options *PacmanSection
+	Repos   []*PacmanSection
+}
+
+func newPacmanSection(name string) *PacmanSection {
+	return &PacmanSection{name, make(map[string][]string)}
+}
+
+// Get returns the last value of key, or "" if it is not set.
+func (sect *PacmanSection) Get(key string) string {
+	vals := sect.values[key]
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[len(vals)-1]
+}
+
+// GetAll returns every value of key. Values that are whitespace separated
+// lists, like CacheDir or SigLevel, are split up.
+func (sect *PacmanSection) GetAll(key string) []string {
+	return sect.values[key]
+}
+
+func (sect *PacmanSection) add(key, val string) {
+	switch key {
+	case "CacheDir", "SigLevel", "HoldPkg", "IgnorePkg", "IgnoreGroup",
+		"NoUpgrade", "NoExtract", "SyncFirst":
+		sect.values[key] = append(sect.values[key], strings.Fields(val)...)
+	default:
+		sect.values[key] = append(sect.values[key], val)
+	}
+}
+
+// ReadPacmanConf parses the pacman.conf file at confpath, following any Include
+// directives.
+func ReadPacmanConf(confpath string) (*PacmanConf, os.Error) {
+	conf := &PacmanConf{Options: newPacmanSection("options")}
+	if err := conf.parseFile(confpath, conf.Options); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// parseFile parses the lines of confpath into conf. sect is the section we are
+// in when the file starts. This matters for included files, like mirrorlists,
+// which continue the section they were included from.
+func (conf *PacmanConf) parseFile(confpath string, sect *PacmanSection) os.Error {
+	file, err := os.Open(confpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, prefix, err := reader.ReadLine()
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if prefix {
+			return os.NewError("Extremely long line in " + confpath)
+		}
+
+		text := string(line)
+		if idx := strings.Index(text, "#"); idx != -1 {
+			text = text[:idx]
+		}
+		text = strings.TrimSpace(text)
+
+		switch {
+		case text == "":
+			continue
+		case text[0] == '[' && text[len(text)-1] == ']':
+			name := text[1 : len(text)-1]
+			if name == "options" {
+				sect = conf.Options
+			} else {
+				sect = newPacmanSection(name)
+				conf.Repos = append(conf.Repos, sect)
+			}
+			continue
+		}
+
+		key, val := text, ""
+		if idx := strings.Index(text, "="); idx != -1 {
+			key = strings.TrimSpace(text[:idx])
+			val = strings.TrimSpace(text[idx+1:])
+		}
+
+		if key == "Include" {
+			// Included files are read in the context of the current section.
+			if err := conf.parseFile(val, sect); err != nil {
+				return err
+			}
+			continue
+		}
+		sect.add(key, val)
+	}
+
+	return nil
+}
+
+// Repo returns the section for the repo named name, or nil.
+func (conf *PacmanConf) Repo(name string) *PacmanSection {
+	for _, repo := range conf.Repos {
+		if repo.Name == name {
+			return repo
+		}
+	}
+	return nil
+}
+
+// Arch returns the architecture pacman uses for $arch. "auto", or no setting,
+// means the machine's architecture.
+func (conf *PacmanConf) Arch() string {
+	arch := conf.Options.Get("Architecture")
+	if arch != "" && arch != "auto" {
+		return arch
+	}
+	return machineArch()
+}
+
+// machineArch returns the machine's architecture, as uname -m prints it.
+func machineArch() string {
+	var uts syscall.Utsname
+	if errno := syscall.Uname(&uts); errno != 0 {
+		return ""
+	}
+	buf := make([]byte, 0, len(uts.Machine))
+	for _, ch := range uts.Machine {
+		if ch == 0 {
+			break
+		}
+		buf = append(buf, byte(ch))
+	}
+	return string(buf)
+}
+
+// Servers returns the server URLs of the repo named reponame, in order of
+// preference, with $repo and $arch filled in.
+func (conf *PacmanConf) Servers(reponame string) []string {
+	repo := conf.Repo(reponame)
+	if repo == nil {
+		return nil
+	}
+
+	arch := conf.Arch()
+	servers := repo.GetAll("Server")
+	urls := make([]string, len(servers))
+	for i, server := range servers {
+		server = strings.Replace(server, "$repo", reponame, -1)
+		server = strings.Replace(server, "$arch", arch, -1)
+		urls[i] = strings.TrimRight(server, "/")
+	}
+	return urls
+}
+
+// CacheDirs returns pacman's package cache dirs. conf may be nil, in which case
+// the default cache dir is used.
+func CacheDirs(conf *PacmanConf) []string {
+	if conf == nil || len(conf.Options.GetAll("CacheDir")) == 0 {
+		return []string{DefaultCacheDir}
+	}
+	return conf.Options.GetAll("CacheDir")
+}
+
+// MawCacheDir returns the dir maw keeps its caches in when it runs as ourselves:
+// $XDG_CACHE_HOME/maw, or ~/.cache/maw.
+func MawCacheDir() string {
+	cachehome := os.Getenv("XDG_CACHE_HOME")
+	if cachehome == "" {
+		cachehome = path.Join(os.Getenv("HOME"), ".cache")
+	}
+	return path.Join(cachehome, "maw")
+}
+
+// UserCacheDir returns the dir package files are downloaded to when we aren't
+// root and can't write to pacman's cache. It is created if it doesn't exist.
+func UserCacheDir() (string, os.Error) {
+	dir := path.Join(MawCacheDir(), "pkg")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
@@ -0,0 +1,481 @@
+/*	pkgbuild.go
+	Reading the variables of a PKGBUILD without running it, and checking them
+	for things the user should know about before we build the package.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"strings"
+	"io/ioutil"
+)
+
+// PkgbuildVars holds the variables set in a PKGBUILD (or .SRCINFO). Scalars
+// are stored as arrays of one element.
+type PkgbuildVars map[string][]string
+
+// Get returns the first value of the variable, or "".
+func (vars PkgbuildVars) Get(name string) string {
+	vals := vars[name]
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+// ReadPkgbuild reads the variables of the package in srcdir from its PKGBUILD,
+// which is parsed without being executed, so anything computed by shell code
+// is missed. Security checks must use this: the .SRCINFO is written by the
+// packager, and may say anything at all.
+func ReadPkgbuild(srcdir string) (PkgbuildVars, os.Error) {
+	text, err := ioutil.ReadFile(path.Join(srcdir, "PKGBUILD"))
+	if err != nil {
+		return nil, err
+	}
+	return parsePkgbuild(string(text)), nil
+}
+
+// ReadPkgbuildVars reads the variables of the package in srcdir like
+// ReadPkgbuild. A .SRCINFO is only used as a hint: variables the PKGBUILD
+// doesn't set, or sets to values we couldn't expand, are taken from it.
+func ReadPkgbuildVars(srcdir string) (PkgbuildVars, os.Error) {
+	vars, err := ReadPkgbuild(srcdir)
+	if err != nil {
+		return nil, err
+	}
+	text, err := ioutil.ReadFile(path.Join(srcdir, ".SRCINFO"))
+	if err != nil {
+		return vars, nil
+	}
+	for name, vals := range parseSrcInfo(string(text)) {
+		if !isExpanded(vars[name]) {
+			vars[name] = vals
+		}
+	}
+	return vars, nil
+}
+
+// isExpanded returns true if vals has values without any shell code left in
+// them that we didn't run.
+func isExpanded(vals []string) bool {
+	for _, val := range vals {
+		if strings.IndexAny(val, "$`") != -1 {
+			return false
+		}
+	}
+	return len(vals) > 0
+}
+
+// parseSrcInfo parses the "key = value" lines of a .SRCINFO file. Repeated keys
+// are collected into arrays.
+func parseSrcInfo(text string) PkgbuildVars {
+	vars := make(PkgbuildVars)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		idx := strings.Index(line, "=")
+		if idx == -1 {
+			continue
+		}
+		key := strings.TrimSpace(line[:idx])
+		vars[key] = append(vars[key], strings.TrimSpace(line[idx+1:]))
+	}
+	return vars
+}
+
+// parsePkgbuild picks out top-level assignments like name=value and
+// name=(value value...) from PKGBUILD text. Simple $var and ${var} references to
+// variables assigned earlier are expanded, and so are braces in arrays, as in
+// source=(foo.tar.gz{,.sig}). Assignments inside functions are ignored.
+func parsePkgbuild(text string) PkgbuildVars {
+	vars := make(PkgbuildVars)
+	words := shellWords(text)
+
+	depth := 0
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		switch {
+		case word == "{":
+			depth++
+			continue
+		case word == "}":
+			depth--
+			continue
+		case depth > 0:
+			continue
+		}
+
+		idx := strings.Index(word, "=")
+		if idx < 1 || !isShellName(word[:idx]) {
+			continue
+		}
+		name, val := word[:idx], word[idx+1:]
+
+		if val == "" && i+1 < len(words) && words[i+1] == "(" {
+			// Array assignment, collect words up to the closing paren.
+			arr := []string{}
+			for i += 2; i < len(words) && words[i] != ")"; i++ {
+				for _, elem := range expandBraces(words[i]) {
+					arr = append(arr, expandShellVars(elem, vars))
+				}
+			}
+			vars[name] = arr
+		} else {
+			vars[name] = []string{expandShellVars(val, vars)}
+		}
+	}
+	return vars
+}
+
+// The arrays of dependencies that must be installed to build a package.
+var buildDepArrays = []string{"depends", "makedepends", "checkdepends"}
+
+// BuildDeps returns the dependency specs (like "foo>=1.0") that must be
+// installed before the package can be built on arch: its depends, makedepends
+// and checkdepends, including the ones for arch alone.
+func BuildDeps(vars PkgbuildVars, arch string) []string {
+	deps := make([]string, 0, 16)
+	for _, arrname := range buildDepArrays {
+		for _, name := range []string{arrname, arrname + "_" + arch} {
+			for _, dep := range vars[name] {
+				if dep != "" && !containsString(deps, dep) {
+					deps = append(deps, dep)
+				}
+			}
+		}
+	}
+	return deps
+}
+
+func isShellName(name string) bool {
+	for i, ch := range name {
+		switch {
+		case ch == '_', 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z':
+		case i > 0 && '0' <= ch && ch <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// shellWords splits shell code into words, much like the shell itself would.
+// Quotes are removed, comments are skipped and the parens and braces that
+// delimit arrays and function bodies are returned as words of their own.
+// Variable references and braces within words are left as they are.
+func shellWords(text string) []string {
+	words := make([]string, 0, 256)
+	word := make([]int, 0, 64)
+	inword := false
+	nesting := 0 // inside ${...} or $(...)
+	braces := 0  // inside {...} within a word
+	funcparens := false
+
+	endWord := func() {
+		if inword {
+			words = append(words, string(word))
+			word = word[:0]
+			inword = false
+		}
+		braces = 0
+	}
+	lastIs := func(ch int) bool {
+		return len(word) > 0 && word[len(word)-1] == ch
+	}
+
+	runes := []int(text)
+	for i := 0; i < len(runes); i++ {
+		ch := runes[i]
+		switch {
+		case nesting > 0:
+			word = append(word, ch)
+			if ch == '(' || ch == '{' {
+				nesting++
+			} else if ch == ')' || ch == '}' {
+				nesting--
+			}
+		case (ch == '(' || ch == '{') && lastIs('$'):
+			word = append(word, ch)
+			nesting++
+		case ch == ' ', ch == '\t', ch == '\n', ch == ';':
+			endWord()
+		case ch == '#' && !inword:
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case ch == '(' && inword && !lastIs('='):
+			// Function definitions: name() {
+			endWord()
+			funcparens = true
+		case ch == ')' && funcparens:
+			funcparens = false
+		case ch == '{' && (inword || i+1 < len(runes) && !isBlank(runes[i+1])):
+			// Only a { on its own starts a function body.
+			inword = true
+			word = append(word, ch)
+			braces++
+		case ch == '}' && braces > 0:
+			word = append(word, ch)
+			braces--
+		case ch == '(', ch == ')', ch == '{', ch == '}':
+			endWord()
+			words = append(words, string(ch))
+		case ch == '\'' || ch == '"':
+			inword = true
+			for i++; i < len(runes) && runes[i] != ch; i++ {
+				if ch == '"' && runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				word = append(word, runes[i])
+			}
+		case ch == '\\':
+			// An escaped newline joins lines, it doesn't start a word.
+			if i+1 < len(runes) && runes[i+1] != '\n' {
+				inword = true
+				word = append(word, runes[i+1])
+			}
+			i++
+		default:
+			inword = true
+			word = append(word, ch)
+		}
+	}
+	endWord()
+
+	return words
+}
+
+func isBlank(ch int) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n'
+}
+
+// expandBraces does the shell's brace expansion of word: "a{b,c}d" becomes
+// "abd" and "acd". Only lists are expanded, not sequences like {1..3}.
+func expandBraces(word string) []string {
+	for start := 0; start < len(word); start++ {
+		if word[start] != '{' || (start > 0 && word[start-1] == '$') {
+			continue
+		}
+
+		// Find the matching brace and the commas at this level.
+		depth, end := 0, -1
+		commas := make([]int, 0, 4)
+		for i := start; i < len(word) && end == -1; i++ {
+			switch word[i] {
+			case '{':
+				depth++
+			case '}':
+				if depth--; depth == 0 {
+					end = i
+				}
+			case ',':
+				if depth == 1 {
+					commas = append(commas, i)
+				}
+			}
+		}
+		if end == -1 {
+			break
+		}
+		if len(commas) == 0 {
+			// Not a list, but there may be one inside.
+			continue
+		}
+
+		prefix, suffix := word[:start], word[end+1:]
+		expanded := make([]string, 0, len(commas)+1)
+		prev := start + 1
+		for _, sep := range append(commas, end) {
+			expanded = append(expanded, expandBraces(prefix+word[prev:sep]+suffix)...)
+			prev = sep + 1
+		}
+		return expanded
+	}
+	return []string{word}
+}
+
+// expandShellVars replaces $name and ${name} in word with the values of
+// variables assigned before. Anything more complicated is left alone.
+func expandShellVars(word string, vars PkgbuildVars) string {
+	if strings.Index(word, "$") == -1 {
+		return word
+	}
+
+	expanded := make([]string, 0, 8)
+	for {
+		idx := strings.Index(word, "$")
+		if idx == -1 || idx == len(word)-1 {
+			break
+		}
+		expanded = append(expanded, word[:idx])
+		word = word[idx+1:]
+
+		var name string
+		if word[0] == '{' {
+			end := strings.Index(word, "}")
+			if end == -1 || !isShellName(word[1:end]) {
+				expanded = append(expanded, "$")
+				continue
+			}
+			name, word = word[1:end], word[end+1:]
+		} else {
+			end := 0
+			for end < len(word) && isShellName(word[:end+1]) {
+				end++
+			}
+			name, word = word[:end], word[end:]
+		}
+
+		if vals, ok := vars[name]; ok && name != "" {
+			expanded = append(expanded, strings.Join(vals, " "))
+		} else {
+			expanded = append(expanded, "$"+name)
+		}
+	}
+	expanded = append(expanded, word)
+
+	return strings.Join(expanded, "")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SECURITY CHECKS
+
+type SecurityIssue struct {
+	Kind   string
+	Detail string
+}
+
+// SecurityPolicy decides what to do with packages that have security issues.
+type SecurityPolicy int
+
+const (
+	PolicyWarn   SecurityPolicy = iota // print the issues, then build anyway
+	PolicyRefuse                       // refuse to build packages with any issues
+)
+
+var (
+	checksumArrays = []string{"md5sums", "sha1sums", "sha224sums", "sha256sums",
+		"sha384sums", "sha512sums", "b2sums"}
+	vcsPrefixes = []string{"git", "hg", "svn", "bzr", "fossil"}
+)
+
+// isVCSSource returns true if src is a VCS source, like git+https://...
+func isVCSSource(src string) bool {
+	url := src
+	if idx := strings.Index(url, "::"); idx != -1 {
+		url = url[idx+2:]
+	}
+	for _, prefix := range vcsPrefixes {
+		if strings.HasPrefix(url, prefix+"+") || strings.HasPrefix(url, prefix+"://") {
+			return true
+		}
+	}
+	return false
+}
+
+// isSignatureSource returns true if the source src is the signature of
+// another, which makepkg checks against validpgpkeys. makepkg goes by the
+// name the file is saved as, which may be given before a "::".
+func isSignatureSource(src string) bool {
+	name := src
+	if idx := strings.Index(src, "::"); idx != -1 {
+		name = src[:idx]
+	}
+	return strings.HasSuffix(name, ".sig") || strings.HasSuffix(name, ".sign") ||
+		strings.HasSuffix(name, ".asc")
+}
+
+// CheckPkgbuild looks for things in the PKGBUILD variables that weaken the
+// guarantee that what we build is what the packager intended: skipped
+// checksums, sources downloaded without encryption, signatures that can't be
+// checked, and install scripts that run as root.
+func CheckPkgbuild(vars PkgbuildVars) []SecurityIssue {
+	issues := make([]SecurityIssue, 0, 8)
+	addIssue := func(kind, format string, args ...interface{}) {
+		issues = append(issues, SecurityIssue{kind, fmt.Sprintf(format, args...)})
+	}
+
+	// Arch specific arrays (source_x86_64, sha256sums_i686...) count too.
+	// A SKIP is fine for signatures and VCS sources, which makepkg can't
+	// checksum; they are checked below. The checksums of source_x86_64 are
+	// in the *sums_x86_64 arrays, in the same order.
+	var sources []string
+	hassums := false
+	skipped := 0
+	for name, vals := range vars {
+		if name == "source" || strings.HasPrefix(name, "source_") {
+			sources = append(sources, vals...)
+		}
+		for _, arrname := range checksumArrays {
+			if name != arrname && !strings.HasPrefix(name, arrname+"_") {
+				continue
+			}
+			hassums = true
+			arrsources := vars["source"+name[len(arrname):]]
+			for i, sum := range vals {
+				if sum != "SKIP" {
+					continue
+				}
+				if i < len(arrsources) && (isSignatureSource(arrsources[i]) ||
+					isVCSSource(arrsources[i])) {
+					continue
+				}
+				skipped++
+			}
+		}
+	}
+
+	if len(sources) > 0 && !hassums {
+		addIssue("checksums", "no checksums for %d sources", len(sources))
+	}
+	if skipped > 0 {
+		addIssue("checksums", "%d checksums are SKIP", skipped)
+	}
+
+	signed := false
+	for _, src := range sources {
+		url := src
+		if idx := strings.Index(url, "::"); idx != -1 {
+			url = url[idx+2:]
+		}
+		if idx := strings.Index(url, "+"); idx != -1 && isVCSSource(src) {
+			url = url[idx+1:]
+		}
+
+		switch {
+		case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "ftp://"),
+			strings.HasPrefix(url, "git://"), strings.HasPrefix(url, "svn://"):
+			addIssue("insecure source", "%s is not downloaded over an encrypted connection", url)
+		}
+		if isSignatureSource(src) || strings.Contains(url, "?signed") {
+			signed = true
+		} else if isVCSSource(src) {
+			addIssue("unsigned source", "%s is an unsigned VCS source", url)
+		}
+	}
+	if signed && len(vars["validpgpkeys"]) == 0 {
+		addIssue("signature", "sources are signed but validpgpkeys is empty")
+	}
+
+	if install := vars.Get("install"); install != "" {
+		addIssue("install script", "%s runs as root when the package is installed", install)
+	}
+
+	return issues
+}
+
+// printSecurityIssues prints a summary of the issues found in pkgname.
+func printSecurityIssues(pkgname string, issues []SecurityIssue) {
+	if len(issues) == 0 {
+		return
+	}
+	fmt.Printf(":: %s has %d security issues:\n", pkgname, len(issues))
+	for _, issue := range issues {
+		fmt.Printf("   %s: %s\n", issue.Kind, issue.Detail)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"io/ioutil"
+)
+
+// PKGBUILD snippets and some of the variables parsePkgbuild should find in
+// them. Arrays are joined with "|" for comparison.
+var parseTests = []struct {
+	name, text string
+	want       map[string]string
+}{
+	{"scalars", "pkgname=foo\npkgver=1.0\npkgrel=1\n",
+		map[string]string{"pkgname": "foo", "pkgver": "1.0", "pkgrel": "1"}},
+	{"semicolons", "pkgname=foo; pkgver=1.0\n",
+		map[string]string{"pkgname": "foo", "pkgver": "1.0"}},
+	{"comments", "# pkgname=bar\npkgname=foo # not bar\n",
+		map[string]string{"pkgname": "foo"}},
+	{"not a name", "1x=2\nx-y=3\n", map[string]string{"1x": "", "x-y": ""}},
+
+	{"array", "arch=(x86_64 i686)\n", map[string]string{"arch": "x86_64|i686"}},
+	{"multiline array", "depends=(\n  'glibc'  # libc\n  zlib\n)\n",
+		map[string]string{"depends": "glibc|zlib"}},
+	{"empty array", "depends=()\n", map[string]string{"depends": ""}},
+	{"array reassigned", "depends=(a b)\ndepends=(c)\n", map[string]string{"depends": "c"}},
+
+	{"single quotes", "pkgdesc='A \"quoted\" $thing'\n",
+		map[string]string{"pkgdesc": "A \"quoted\" $thing"}},
+	{"double quotes", "pkgdesc=\"It's got spaces\"\n",
+		map[string]string{"pkgdesc": "It's got spaces"}},
+	{"escaped quote", "pkgdesc=\"say \\\"hi\\\"\"\n", map[string]string{"pkgdesc": "say \"hi\""}},
+	{"backslash", "pkgdesc=two\\ words\n", map[string]string{"pkgdesc": "two words"}},
+	{"line continuation", "depends=(a \\\n  b)\n", map[string]string{"depends": "a|b"}},
+	{"quoted parens", "pkgdesc='(not an array)'\n",
+		map[string]string{"pkgdesc": "(not an array)"}},
+	{"quoted array elements", "source=('a b' \"c d\")\n", map[string]string{"source": "a b|c d"}},
+
+	{"variables", "pkgname=foo\npkgver=1.0\nsource=(\"https://x.org/$pkgname-${pkgver}.tar.gz\")\n",
+		map[string]string{"source": "https://x.org/foo-1.0.tar.gz"}},
+	{"array variable", "_deps=(a b)\ndepends=(\"$_deps\")\n", map[string]string{"depends": "a b"}},
+	{"unknown variable", "source=($_unset/x)\n", map[string]string{"source": "$_unset/x"}},
+	{"later variable", "source=($pkgname)\npkgname=foo\n", map[string]string{"source": "$pkgname"}},
+	{"command substitution", "pkgver=$(date +%s)\n", map[string]string{"pkgver": "$(date +%s)"}},
+	{"parameter expansion", "pkgver=1.0\n_v=${pkgver//./_}\n", map[string]string{"_v": "${pkgver//./_}"}},
+
+	{"braces", "source=(foo.tar.gz{,.sig})\n", map[string]string{"source": "foo.tar.gz|foo.tar.gz.sig"}},
+	{"braces in the middle", "source=(a{b,c,d}e)\n", map[string]string{"source": "abe|ace|ade"}},
+	{"nested braces", "source=(a{b,c{d,e}})\n", map[string]string{"source": "ab|acd|ace"}},
+	{"two brace lists", "_x=({a,b}{1,2})\n", map[string]string{"_x": "a1|a2|b1|b2"}},
+	{"braces and variables", "pkgname=foo\nsource=(\"$pkgname.tar.gz\"{,.asc})\n",
+		map[string]string{"source": "foo.tar.gz|foo.tar.gz.asc"}},
+	{"brace without a list", "_x=(a{b}c)\n", map[string]string{"_x": "a{b}c"}},
+	{"braces in a scalar", "_x=a{b,c}\n", map[string]string{"_x": "a{b,c}"}},
+
+	{"functions", "pkgname=foo\nbuild() {\n  pkgname=bar\n  cd \"$srcdir\"\n}\npkgver=1.0\n",
+		map[string]string{"pkgname": "foo", "pkgver": "1.0"}},
+	{"function keyword", "function _helper {\n  depends=(evil)\n}\ndepends=(ok)\n",
+		map[string]string{"depends": "ok"}},
+	{"nested blocks", "package() {\n  if true; then { x=1; }; fi\n  url=bad\n}\nurl=good\n",
+		map[string]string{"url": "good", "x": ""}},
+	{"braces inside a function", "package() {\n  install -m644 {a,b} \"$pkgdir\"\n  url=bad\n}\nurl=good\n",
+		map[string]string{"url": "good"}},
+	{"one line function", "prepare() { patch=bad; }\npatch=good\n", map[string]string{"patch": "good"}},
+}
+
+func TestParsePkgbuild(t *testing.T) {
+	for _, test := range parseTests {
+		vars := parsePkgbuild(test.text)
+		for name, want := range test.want {
+			if got := strings.Join(vars[name], "|"); got != want {
+				t.Errorf("%s: %s = %q, want %q", test.name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestParseSrcInfo(t *testing.T) {
+	vars := parseSrcInfo("pkgbase = foo\n\tpkgver = 1.0\n\tsource = a.tar.gz\n" +
+		"\tsource = a.tar.gz.sig\n\n# comment\npkgname = foo\n")
+	if vars.Get("pkgver") != "1.0" || vars.Get("pkgname") != "foo" {
+		t.Errorf("got pkgver %q, pkgname %q", vars.Get("pkgver"), vars.Get("pkgname"))
+	}
+	if source := strings.Join(vars["source"], "|"); source != "a.tar.gz|a.tar.gz.sig" {
+		t.Errorf("source = %q", source)
+	}
+}
+
+// The PKGBUILD is what gets built, so a .SRCINFO that says otherwise is
+// only believed where the PKGBUILD couldn't be read without running it.
+func TestReadPkgbuildVars(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	pkgbuild := "pkgname=foo\npkgver=$(date +%Y)\ndepends=(bar)\n" +
+		"source=(http://x.org/a.tar.gz)\nsha256sums=(SKIP)\n"
+	srcinfo := "pkgbase = foo\n\tpkgver = 2011\n\tdepends = baz\n" +
+		"\tsource = https://x.org/a.tar.gz\n\tsha256sums = abcd\n\npkgname = foo\n"
+	if err := ioutil.WriteFile(path.Join(dir, "PKGBUILD"), []byte(pkgbuild), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, ".SRCINFO"), []byte(srcinfo), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	vars, err := ReadPkgbuildVars(dir)
+	if err != nil {
+		t.Fatalf("ReadPkgbuildVars: %s", err)
+	}
+	want := map[string]string{"pkgname": "foo", "pkgbase": "foo", "pkgver": "2011",
+		"depends": "bar", "source": "http://x.org/a.tar.gz", "sha256sums": "SKIP"}
+	for name, want := range want {
+		if got := strings.Join(vars[name], "|"); got != want {
+			t.Errorf("ReadPkgbuildVars: %s = %q, want %q", name, got, want)
+		}
+	}
+
+	vars, err = ReadPkgbuild(dir)
+	if err != nil {
+		t.Fatalf("ReadPkgbuild: %s", err)
+	}
+	if pkgbase, ok := vars["pkgbase"]; ok {
+		t.Errorf("ReadPkgbuild: pkgbase = %q from the .SRCINFO", pkgbase)
+	}
+	if issues := CheckPkgbuild(vars); len(issues) != 2 {
+		t.Errorf("CheckPkgbuild found %d issues, want the insecure source and SKIP", len(issues))
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	tests := []struct{ word, want string }{
+		{"plain", "plain"},
+		{"a{b,c}", "ab ac"},
+		{"{,x}", " x"},
+		{"{a,b}{c,d}", "ac ad bc bd"},
+		{"a{b,{c,d}e}", "ab ace ade"},
+		{"{a}", "{a}"},
+		{"{a}{b,c}", "{a}b {a}c"},
+		{"${x}{1,2}", "${x}1 ${x}2"},
+		{"{${x},y}", "${x} y"},
+		{"{a,b", "{a,b"},
+		{"a}b,c{", "a}b,c{"},
+	}
+	for _, test := range tests {
+		if got := strings.Join(expandBraces(test.word), " "); got != test.want {
+			t.Errorf("expandBraces(%q) = %q, want %q", test.word, got, test.want)
+		}
+	}
+}
+
+func TestBuildDeps(t *testing.T) {
+	vars := parsePkgbuild("depends=(glibc 'zlib>=1.2')\nmakedepends=(cmake glibc)\n" +
+		"checkdepends=(python)\nmakedepends_x86_64=(nasm)\nmakedepends_i686=(yasm)\n" +
+		"optdepends=('gtk3: gui')\n")
+	deps := strings.Join(BuildDeps(vars, "x86_64"), " ")
+	if deps != "glibc zlib>=1.2 cmake nasm python" {
+		t.Errorf("BuildDeps = %q", deps)
+	}
+}
+
+// Each PKGBUILD has the security issues of the kinds listed, in that order.
+var checkTests = []struct {
+	name, text string
+	kinds      []string
+}{
+	{"clean", testPkgbuild, nil},
+	{"no sources", "pkgname=foo\n", nil},
+	{"no checksums", "source=(https://x.org/a.tar.gz)\n", []string{"checksums"}},
+	{"skipped checksum", "source=(https://x.org/a.tar.gz local.patch)\nsha256sums=(SKIP abcd)\n",
+		[]string{"checksums"}},
+	{"arch checksums", "source_x86_64=(https://x.org/a.tar.gz)\nsha512sums_x86_64=(abcd)\n", nil},
+	{"arch checksum skipped", "source=(https://x.org/a.tar.gz)\nb2sums_i686=(SKIP)\n",
+		[]string{"checksums"}},
+	{"http source", "source=(http://x.org/a.tar.gz)\nmd5sums=(abcd)\n",
+		[]string{"insecure source"}},
+	{"renamed ftp source", "source=(a.tar.gz::ftp://x.org/b.tar.gz)\nsha1sums=(abcd)\n",
+		[]string{"insecure source"}},
+	{"unsigned git source", "source=(git+https://x.org/a.git)\nsha256sums=(SKIP)\n",
+		[]string{"unsigned source"}},
+	{"signed git source", "source=('git+https://x.org/a.git#tag=v1?signed')\n" +
+		"sha256sums=(abcd)\nvalidpgpkeys=(ABCD)\n", nil},
+	{"git protocol", "source=(git://x.org/a.git)\nsha256sums=(abcd)\n",
+		[]string{"insecure source", "unsigned source"}},
+	{"svn source", "source=(svn+http://x.org/a)\nsha256sums=(abcd)\n",
+		[]string{"insecure source", "unsigned source"}},
+	{"signed source", "source=(https://x.org/a.tar.gz{,.sig})\nsha256sums=(abcd SKIP)\n" +
+		"validpgpkeys=(0123456789ABCDEF0123456789ABCDEF01234567)\n", nil},
+	{"renamed signature", "source=(a.tar.gz::https://x.org/1 a.tar.gz.asc::https://x.org/2)\n" +
+		"sha256sums=(abcd SKIP)\nvalidpgpkeys=(0123456789ABCDEF0123456789ABCDEF01234567)\n", nil},
+	{"arch signature", "source_x86_64=(https://x.org/a.tar.gz{,.sig})\n" +
+		"sha256sums_x86_64=(abcd SKIP)\nvalidpgpkeys=(0123456789ABCDEF0123456789ABCDEF01234567)\n",
+		nil},
+	{"skipped arch checksum", "source=(git+https://x.org/a.git?signed)\n" +
+		"source_i686=(https://x.org/a.tar.gz)\nsha256sums=(SKIP)\nsha256sums_i686=(SKIP)\n" +
+		"validpgpkeys=(0123456789ABCDEF0123456789ABCDEF01234567)\n",
+		[]string{"checksums"}},
+	{"missing validpgpkeys", "source=(https://x.org/a.tar.gz{,.asc})\nsha256sums=(abcd abcd)\n",
+		[]string{"signature"}},
+	{"install script", "install=foo.install\n", []string{"install script"}},
+	{"everything", "source=(http://x.org/a.tar.gz{,.sig} git+https://x.org/b.git)\n" +
+		"sha256sums=(SKIP SKIP SKIP)\ninstall=foo.install\n",
+		[]string{"checksums", "insecure source", "insecure source", "unsigned source",
+			"signature", "install script"}},
+}
+
+func TestCheckPkgbuild(t *testing.T) {
+	for _, test := range checkTests {
+		issues := CheckPkgbuild(parsePkgbuild(test.text))
+		kinds := make([]string, len(issues))
+		for i, issue := range issues {
+			kinds[i] = issue.Kind
+		}
+		if strings.Join(kinds, ", ") != strings.Join(test.kinds, ", ") {
+			t.Errorf("%s: got issues %v, want %v", test.name, issues, test.kinds)
+		}
+	}
+}
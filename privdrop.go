@@ -0,0 +1,312 @@
+/*	privdrop.go
+	Running build commands as an unprivileged user. When maw runs as root we
+	don't want makepkg to, so the child gets the build user's uid, gid and
+	supplementary groups, and a clean environment. The build user is the one
+	we were told to use, the one who ran sudo, or else a system user of our
+	own whose home holds the build trees.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"bufio"
+	"strings"
+	"strconv"
+	"syscall"
+)
+
+const (
+	PasswdPath = "/etc/passwd"
+	GroupPath  = "/etc/group"
+	BuildPath  = "/usr/local/sbin:/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin"
+)
+
+const (
+	DefaultBuildUser = "maw"
+	DefaultBuildHome = "/var/lib/maw"
+)
+
+// Environment variables that are passed on to builds. Everything else is
+// dropped so that root's environment doesn't leak into the build.
+var buildEnvKeep = []string{"TERM", "LANG", "TZ", "MAKEFLAGS",
+	"http_proxy", "https_proxy", "ftp_proxy", "no_proxy",
+	"PKGDEST", "SRCDEST", "SRCPKGDEST", "LOGDEST", "BUILDDIR", "PACKAGER", "GPGKEY"}
+
+// BuildUser is the user that builds are run as.
+type BuildUser struct {
+	Name   string
+	Uid    int
+	Gid    int
+	Groups []int // supplementary groups
+	Home   string
+}
+
+// readColonFile reads a colon separated file like /etc/passwd and returns the
+// fields of each line.
+func readColonFile(filepath string) ([][]string, os.Error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([][]string, 0, 64)
+	reader := bufio.NewReader(file)
+	for {
+		line, prefix, err := reader.ReadLine()
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if prefix {
+			return nil, os.NewError("Extremely long line in " + filepath)
+		}
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		entries = append(entries, strings.Split(string(line), ":"))
+	}
+	return entries, nil
+}
+
+// getentEntries asks NSS for the entries of the database db (passwd, group),
+// or only for the entry of key if key is not "", with getent. The entries
+// are split into fields like readColonFile does.
+func getentEntries(cn *Canceler, db, key string) ([][]string, os.Error) {
+	args := []string{db}
+	if key != "" {
+		args = append(args, key)
+	}
+	cmd := &Command{Name: "getent", Args: args, Capture: true, Quiet: true}
+	result, err := CmdRunner.Run(cn, cmd)
+	if err != nil {
+		return nil, err
+	}
+	// getent exits with 2 if there is no such entry.
+	if result.ExitStatus == 2 {
+		return nil, nil
+	}
+	if err = result.Err(cmd); err != nil {
+		return nil, err
+	}
+
+	entries := make([][]string, 0, 64)
+	for _, line := range strings.Split(string(result.Stdout), "\n") {
+		if line != "" {
+			entries = append(entries, strings.Split(line, ":"))
+		}
+	}
+	return entries, nil
+}
+
+// findUser returns the user named name in the passwd entries users, or nil if
+// there is no such user. source names where the entries came from.
+func findUser(users [][]string, name, source string) (*BuildUser, os.Error) {
+	for _, fields := range users {
+		if len(fields) < 7 || fields[0] != name {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, os.NewError("Invalid uid for " + name + " in " + source)
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, os.NewError("Invalid gid for " + name + " in " + source)
+		}
+		return &BuildUser{name, uid, gid, nil, fields[5]}, nil
+	}
+	return nil, nil
+}
+
+// LookupBuildUser looks up the user named name in /etc/passwd, and the user's
+// supplementary groups in /etc/group. Users who aren't in /etc/passwd (from
+// LDAP and the like) are looked up with getent instead, and so are their
+// groups.
+func LookupBuildUser(cn *Canceler, name string) (*BuildUser, os.Error) {
+	users, err := readColonFile(PasswdPath)
+	if err != nil {
+		return nil, err
+	}
+	user, err := findUser(users, name, PasswdPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups [][]string
+	if user != nil {
+		groups, err = readColonFile(GroupPath)
+	} else {
+		if users, err = getentEntries(cn, "passwd", name); err != nil {
+			return nil, err
+		}
+		if user, err = findUser(users, name, "getent passwd"); err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, os.NewError("user " + name + " does not exist")
+		}
+		groups, err = getentEntries(cn, "group", "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range groups {
+		if len(fields) < 4 {
+			continue
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member != name {
+				continue
+			}
+			if gid, err := strconv.Atoi(fields[2]); err == nil && gid != user.Gid {
+				user.Groups = append(user.Groups, gid)
+			}
+		}
+	}
+
+	return user, nil
+}
+
+// FindBuildUser returns the user builds should run as. A configured build user
+// (name) comes first, then the user who ran sudo. If there is neither and we
+// are root, the default build user is used; it is created if create is true.
+// nil is returned if we aren't root, in which case builds run as ourselves.
+// Building as root is refused.
+func FindBuildUser(cn *Canceler, name string, create bool) (*BuildUser, os.Error) {
+	if name == "" {
+		name = os.Getenv("SUDO_USER")
+	}
+	if name == "" || name == "root" {
+		if os.Getuid() != 0 {
+			return nil, nil
+		}
+		name = DefaultBuildUser
+	}
+
+	user, err := LookupBuildUser(cn, name)
+	if err != nil && name == DefaultBuildUser && create {
+		user, err = CreateBuildUser(cn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Uid == 0 {
+		return nil, os.NewError("refusing to build packages as root")
+	}
+	return user, nil
+}
+
+// CreateBuildUser creates the default build user as a system user. It gets no
+// sudo rights: a PKGBUILD runs as this user, so anything it may run as root
+// the PKGBUILD may too. Dependencies are installed by us before building.
+func CreateBuildUser(cn *Canceler) (*BuildUser, os.Error) {
+	fmt.Printf(":: Creating build user %s\n", DefaultBuildUser)
+	err := runCommand(cn, "", "useradd", "--system", "--create-home",
+		"--home-dir", DefaultBuildHome, "--shell", "/usr/bin/nologin",
+		DefaultBuildUser)
+	if err != nil {
+		return nil, err
+	}
+	return LookupBuildUser(cn, DefaultBuildUser)
+}
+
+// CacheRoot returns the dir maw keeps the user's source packages and build
+// trees in. Nothing else is kept there, so cleaning it can't remove files maw
+// didn't create. The default build user, which we created for this, keeps them
+// in its home; any other user in ~/.cache/maw. The nil user is ourselves.
+func (user *BuildUser) CacheRoot() string {
+	switch {
+	case user == nil:
+		return MawCacheDir()
+	case user.Name == DefaultBuildUser && user.Home == DefaultBuildHome:
+		return user.Home
+	}
+	return path.Join(user.Home, ".cache", "maw")
+}
+
+// AURCacheDirs returns the dirs in CacheRoot that source packages are
+// downloaded to, and extracted and built in. If create is true, they are
+// created if they don't exist, and given to the user.
+func (user *BuildUser) AURCacheDirs(create bool) (srcdest, buildroot string, err os.Error) {
+	root := user.CacheRoot()
+	srcdest, buildroot = path.Join(root, "src"), path.Join(root, "build")
+	if !create {
+		return srcdest, buildroot, nil
+	}
+
+	for _, dir := range []string{srcdest, buildroot} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return "", "", err
+		}
+	}
+	if user == nil {
+		return srcdest, buildroot, nil
+	}
+
+	// MkdirAll runs as root, so whatever it made in the home belongs to root.
+	dirs := []string{srcdest, buildroot}
+	for dir := root; strings.HasPrefix(dir, user.Home); dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == user.Home || dir == path.Dir(dir) {
+			break
+		}
+	}
+	for _, dir := range dirs {
+		if err = os.Chown(dir, user.Uid, user.Gid); err != nil {
+			return "", "", err
+		}
+	}
+	return srcdest, buildroot, nil
+}
+
+// Environ returns the environment for a child run as user: the variables from
+// our own environment that are in buildEnvKeep (plus the locale settings),
+// along with the user's HOME, USER and LOGNAME. If user is nil, our environment
+// is passed on unchanged. extra is added at the end, as NAME=value strings.
+func (user *BuildUser) Environ(extra ...string) []string {
+	if user == nil {
+		return append(os.Environ(), extra...)
+	}
+
+	env := make([]string, 0, 32)
+	for _, keyval := range os.Environ() {
+		key := keyval
+		if idx := strings.Index(keyval, "="); idx != -1 {
+			key = keyval[:idx]
+		}
+		if strings.HasPrefix(key, "LC_") {
+			env = append(env, keyval)
+			continue
+		}
+		for _, keep := range buildEnvKeep {
+			if key == keep {
+				env = append(env, keyval)
+				break
+			}
+		}
+	}
+
+	env = append(env, "HOME="+user.Home, "USER="+user.Name, "LOGNAME="+user.Name,
+		"PATH="+BuildPath)
+	return append(env, extra...)
+}
+
+// SysProcAttr returns the attributes that make a child process run as user.
+// If user is nil, nil is returned and the child runs as we do.
+func (user *BuildUser) SysProcAttr() *syscall.SysProcAttr {
+	if user == nil {
+		return nil
+	}
+	groups := make([]uint32, len(user.Groups))
+	for i, gid := range user.Groups {
+		groups[i] = uint32(gid)
+	}
+	cred := &syscall.Credential{uint32(user.Uid), uint32(user.Gid), groups}
+	return &syscall.SysProcAttr{Credential: cred}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+// A user from LDAP or the like, who is only known to getent.
+const testNSSUser = "maw-test-ldap"
+
+func TestLookupBuildUserGetent(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["getent passwd "+testNSSUser] = &CmdResult{Stdout: []byte(
+		testNSSUser + ":*:5001:5000:LDAP user:/home/" + testNSSUser + ":/bin/bash\n")}
+	fake.Results["getent group"] = &CmdResult{Stdout: []byte(
+		"staff:*:5000:" + testNSSUser + "\n" +
+			"builders:*:5002:alice," + testNSSUser + "\n" +
+			"wheel:x:10:alice\n")}
+
+	user, err := LookupBuildUser(NewCanceler(), testNSSUser)
+	if err != nil {
+		t.Fatalf("LookupBuildUser: %s", err)
+	}
+	if user.Uid != 5001 || user.Gid != 5000 || user.Home != "/home/"+testNSSUser {
+		t.Errorf("got uid %d, gid %d, home %s", user.Uid, user.Gid, user.Home)
+	}
+	// The primary group isn't a supplementary group too.
+	if len(user.Groups) != 1 || user.Groups[0] != 5002 {
+		t.Errorf("groups %v, want [5002]", user.Groups)
+	}
+	checkRan(t, fake, "getent passwd "+testNSSUser, "getent group")
+}
+
+func TestLookupBuildUserMissing(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["getent"] = &CmdResult{ExitStatus: 2}
+
+	if user, err := LookupBuildUser(NewCanceler(), testNSSUser); err == nil {
+		t.Errorf("LookupBuildUser of a missing user returned %v", user)
+	}
+	checkRan(t, fake, "getent passwd "+testNSSUser)
+}
+
+// Users in /etc/passwd don't need getent.
+func TestLookupBuildUserFiles(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+
+	user, err := LookupBuildUser(NewCanceler(), "root")
+	if err != nil {
+		t.Fatalf("LookupBuildUser: %s", err)
+	}
+	if user.Uid != 0 {
+		t.Errorf("root has uid %d", user.Uid)
+	}
+	checkRan(t, fake)
+}
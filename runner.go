@@ -0,0 +1,235 @@
+/*	runner.go
+	Running external commands: pacman, makepkg and the rest. They are
+	all run through CmdRunner, so that they can be faked and the code that
+	uses them tested on systems without pacman.
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"exec"
+	"strings"
+	"io/ioutil"
+)
+
+const (
+	MaxStderrCapture = 16 << 10 // bytes of stderr kept for error messages
+)
+
+// Where the programs we run live, unless configured otherwise.
+var DefaultCmdPaths = map[string]string{
+	"pacman":  "/usr/bin/pacman",
+	"makepkg": MakepkgPath,
+	"xz":      XzPath,
+	"zstd":    ZstdPath,
+	"getent":  "/usr/bin/getent",
+	"gpg":     "/usr/bin/gpg",
+}
+
+// CmdRunner runs every external command. Tests replace it with a fake.
+var CmdRunner Runner = NewExecRunner(nil)
+
+// Command is a command to run. Commands get our stdin, so they can prompt,
+// unless they are given another.
+type Command struct {
+	Name    string     // a name in the runner's paths (or PATH), or a path
+	Args    []string   // not including the name
+	Dir     string     // "" for our working dir
+	User    *BuildUser // run as this user, nil for ourselves
+	Env     []string   // nil for our environment
+	Stdin   *os.File   // nil for our stdin
+	Stdout  *os.File   // nil for our stdout, ignored if Capture is set
+	Capture bool       // capture stdout instead of passing it on
+	Quiet   bool       // capture stderr instead of passing it on
+}
+
+func (cmd *Command) String() string {
+	return strings.Join(append([]string{cmd.Name}, cmd.Args...), " ")
+}
+
+// CmdResult is what a Command did.
+type CmdResult struct {
+	ExitStatus int
+	Stdout     []byte // only if the command's output was captured
+	Stderr     []byte // the end of what a quiet command wrote to stderr
+}
+
+// Err returns an error for the command if it exited with a non-zero status,
+// with the last line it wrote to stderr if that was captured.
+func (result *CmdResult) Err(cmd *Command) os.Error {
+	if result.ExitStatus == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%s failed with exit status %d", cmd.Name, result.ExitStatus)
+	lines := strings.Split(strings.TrimSpace(string(result.Stderr)), "\n")
+	if last := lines[len(lines)-1]; last != "" {
+		msg += ": " + last
+	}
+	return os.NewError(msg)
+}
+
+// A Runner runs commands, waiting for them to exit. A command that runs but
+// exits with a non-zero status is not an error. Long running commands are
+// registered with cn, so that they can be interrupted.
+type Runner interface {
+	// Path returns the path of the program name.
+	Path(name string) string
+	Run(cn *Canceler, cmd *Command) (*CmdResult, os.Error)
+}
+
+// runCommand runs the command argv in dir, letting it use our terminal, and
+// waits for it to finish. A non-zero exit status is an error.
+func runCommand(cn *Canceler, dir string, argv ...string) os.Error {
+	cmd := &Command{Name: argv[0], Args: argv[1:], Dir: dir}
+	result, err := CmdRunner.Run(cn, cmd)
+	if err != nil {
+		return err
+	}
+	return result.Err(cmd)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ExecRunner really runs commands.
+type ExecRunner struct {
+	paths map[string]string
+}
+
+// NewExecRunner returns an ExecRunner which finds programs in paths, then in
+// DefaultCmdPaths, then in PATH. paths may be nil.
+func NewExecRunner(paths map[string]string) *ExecRunner {
+	allpaths := make(map[string]string)
+	for name, cmdpath := range DefaultCmdPaths {
+		allpaths[name] = cmdpath
+	}
+	for name, cmdpath := range paths {
+		allpaths[name] = cmdpath
+	}
+	return &ExecRunner{allpaths}
+}
+
+func (runner *ExecRunner) Path(name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	if cmdpath, ok := runner.paths[name]; ok {
+		return cmdpath
+	}
+	if cmdpath, err := exec.LookPath(name); err == nil {
+		return cmdpath
+	}
+	return name
+}
+
+func (runner *ExecRunner) Run(cn *Canceler, cmd *Command) (*CmdResult, os.Error) {
+	if cn.Canceled() {
+		return nil, ErrCanceled
+	}
+
+	stdin, stdout, stderr := os.Stdin, os.Stdout, os.Stderr
+	if cmd.Stdin != nil {
+		stdin = cmd.Stdin
+	}
+	if cmd.Stdout != nil {
+		stdout = cmd.Stdout
+	}
+	var outpipe, errpipe *os.File
+	var err os.Error
+	if cmd.Capture {
+		if outpipe, stdout, err = os.Pipe(); err != nil {
+			return nil, err
+		}
+		defer outpipe.Close()
+	}
+	if cmd.Quiet {
+		if errpipe, stderr, err = os.Pipe(); err != nil {
+			if outpipe != nil {
+				stdout.Close()
+			}
+			return nil, err
+		}
+		defer errpipe.Close()
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	attr := &os.ProcAttr{Dir: cmd.Dir, Env: env,
+		Files: []*os.File{stdin, stdout, stderr},
+		Sys:   cmd.User.SysProcAttr()}
+	argv := append([]string{cmd.Name}, cmd.Args...)
+	proc, err := os.StartProcess(runner.Path(cmd.Name), argv, attr)
+
+	// The child has its own copies of the pipes' write ends.
+	if outpipe != nil {
+		stdout.Close()
+	}
+	if errpipe != nil {
+		stderr.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer proc.Release()
+
+	if err := cn.AddProcess(proc); err != nil {
+		proc.Wait(0)
+		return nil, err
+	}
+	defer cn.RemoveProcess(proc)
+
+	// Read stderr while we read stdout, or the command could block on either.
+	errtail := &tailBuffer{max: MaxStderrCapture}
+	errdone := make(chan bool, 1)
+	if errpipe != nil {
+		go func() {
+			io.Copy(errtail, errpipe)
+			errdone <- true
+		}()
+	} else {
+		errdone <- true
+	}
+
+	result := &CmdResult{}
+	var readerr os.Error
+	if outpipe != nil {
+		result.Stdout, readerr = ioutil.ReadAll(outpipe)
+	}
+	<-errdone
+	result.Stderr = errtail.Bytes()
+
+	waitmsg, err := proc.Wait(0)
+	if cn.Canceled() {
+		return nil, ErrCanceled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if readerr != nil {
+		return nil, readerr
+	}
+	result.ExitStatus = waitmsg.ExitStatus()
+	return result, nil
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max  int
+	data []byte
+}
+
+func (buf *tailBuffer) Write(data []byte) (int, os.Error) {
+	buf.data = append(buf.data, data...)
+	if len(buf.data) > buf.max {
+		buf.data = buf.data[len(buf.data)-buf.max:]
+	}
+	return len(data), nil
+}
+
+func (buf *tailBuffer) Bytes() []byte {
+	return buf.data
+}
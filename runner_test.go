@@ -0,0 +1,374 @@
+package main
+
+import (
+	"os"
+	"http"
+	"path"
+	"sync"
+	"bytes"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"http/httptest"
+)
+
+// FakeRunner doesn't run anything. It remembers the commands it was asked to
+// run and returns the result in Results for the command line (as
+// Command.String gives it), or else for the command's name. If there is
+// neither, the result has exit status 0. It is safe to use from many
+// goroutines.
+type FakeRunner struct {
+	Results  map[string]*CmdResult
+	Commands []*Command
+	lock     sync.Mutex
+}
+
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{Results: make(map[string]*CmdResult)}
+}
+
+func (runner *FakeRunner) Path(name string) string {
+	return name
+}
+
+func (runner *FakeRunner) Run(cn *Canceler, cmd *Command) (*CmdResult, os.Error) {
+	if cn.Canceled() {
+		return nil, ErrCanceled
+	}
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+
+	runner.Commands = append(runner.Commands, cmd)
+	if result, ok := runner.Results[cmd.String()]; ok {
+		return result, nil
+	}
+	if result, ok := runner.Results[cmd.Name]; ok {
+		return result, nil
+	}
+	return &CmdResult{}, nil
+}
+
+// Ran returns the command lines that were run, in order.
+func (runner *FakeRunner) Ran() []string {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+
+	cmdlines := make([]string, len(runner.Commands))
+	for i, cmd := range runner.Commands {
+		cmdlines[i] = cmd.String()
+	}
+	return cmdlines
+}
+
+// useFakeRunner replaces CmdRunner with a new FakeRunner until the returned
+// func is called.
+func useFakeRunner() (*FakeRunner, func()) {
+	old := CmdRunner
+	fake := NewFakeRunner()
+	CmdRunner = fake
+	return fake, func() { CmdRunner = old }
+}
+
+// testEscalator escalates like sudo would, without needing sudo.
+func testEscalator() *Escalator {
+	return &Escalator{name: "sudo", cmdpath: "/usr/bin/sudo"}
+}
+
+func checkRan(t *testing.T, fake *FakeRunner, want ...string) {
+	got := fake.Ran()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ran:\n\t%s\nwant:\n\t%s", strings.Join(got, "\n\t"),
+			strings.Join(want, "\n\t"))
+	}
+}
+
+// funcFetcher fetches by calling itself.
+type funcFetcher func(cn *Canceler, pkgname string) ([]string, FetchError)
+
+func (ff funcFetcher) Fetch(cn *Canceler, pkgname string) ([]string, FetchError) {
+	return ff(cn, pkgname)
+}
+
+// fakeFetcher fetches the package paths it maps names to.
+type fakeFetcher map[string][]string
+
+func (ff fakeFetcher) Fetch(cn *Canceler, pkgname string) ([]string, FetchError) {
+	if pkgpaths, ok := ff[pkgname]; ok {
+		return pkgpaths, nil
+	}
+	return nil, NotFoundError(pkgname)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestExecRunnerCapture(t *testing.T) {
+	runner := NewExecRunner(nil)
+	cmd := &Command{Name: "/bin/sh", Args: []string{"-c", "echo out; echo oops >&2; exit 3"},
+		Capture: true, Quiet: true}
+	result, err := runner.Run(NewCanceler(), cmd)
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	if result.ExitStatus != 3 {
+		t.Errorf("exit status %d, want 3", result.ExitStatus)
+	}
+	if string(result.Stdout) != "out\n" {
+		t.Errorf("stdout %q, want %q", result.Stdout, "out\n")
+	}
+	if string(result.Stderr) != "oops\n" {
+		t.Errorf("stderr %q, want %q", result.Stderr, "oops\n")
+	}
+	if err = result.Err(cmd); err == nil || !strings.HasSuffix(err.String(), ": oops") {
+		t.Errorf("Err = %v, want it to end with the stderr line", err)
+	}
+}
+
+func TestExecRunnerStderrPassedOn(t *testing.T) {
+	runner := NewExecRunner(nil)
+	cmd := &Command{Name: "/bin/sh", Args: []string{"-c", "echo passed on >&2"}, Capture: true}
+	result, err := runner.Run(NewCanceler(), cmd)
+	if err != nil {
+		t.Fatalf("Run: %s", err)
+	}
+	if len(result.Stderr) != 0 {
+		t.Errorf("stderr of a command that isn't quiet was captured: %q", result.Stderr)
+	}
+}
+
+func TestExecRunnerCanceled(t *testing.T) {
+	cn := NewCanceler()
+	cn.Cancel(2)
+	_, err := NewExecRunner(nil).Run(cn, &Command{Name: "/bin/true"})
+	if err != ErrCanceled {
+		t.Errorf("Run after cancel returned %v, want ErrCanceled", err)
+	}
+}
+
+func TestFindPackageUrl(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+
+	pkgurl := "http://mirror/core/os/x86_64/foo-1.0-1-x86_64.pkg.tar.zst"
+	fake.Results["pacman -S --print --print-format %r %l foo"] =
+		&CmdResult{Stdout: []byte("core " + pkgurl + "\n")}
+	fake.Results["pacman -S --print --print-format %r %l bar"] =
+		&CmdResult{ExitStatus: 1, Stderr: []byte("error: target not found: bar\n")}
+
+	pf := &PacmanFetcher{}
+	repo, urltext, err := pf.findPackageUrl(NewCanceler(), "foo")
+	if err != nil || repo != "core" || urltext != pkgurl {
+		t.Errorf("foo: got %q %q %v, want core %q", repo, urltext, err, pkgurl)
+	}
+	if _, _, err = pf.findPackageUrl(NewCanceler(), "bar"); err == nil || !err.NotFound() {
+		t.Errorf("bar: got %v, want target not found", err)
+	}
+}
+
+func TestRunDepTest(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["pacman"] = &CmdResult{ExitStatus: 127}
+
+	code := runDepTest(NewCanceler(), &MawOpt{Targets: []string{"foo", "bar>=2"}})
+	if code != 127 {
+		t.Errorf("exit status %d, want pacman's 127", code)
+	}
+	checkRan(t, fake, "pacman -T foo bar>=2")
+}
+
+func TestDepInstaller(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["pacman -T make gcc>=10"] =
+		&CmdResult{ExitStatus: 127, Stdout: []byte("gcc>=10\n")}
+
+	fetcher := NewMultiFetcher(fakeFetcher{"gcc": {"/cache/gcc-10.1-1-x86_64.pkg.tar.zst"}})
+	install := depInstaller(testEscalator(), &fetcher)
+	if err := install(NewCanceler(), []string{"foo"}, []string{"make", "gcc>=10"}); err != nil {
+		t.Fatalf("install: %s", err)
+	}
+	checkRan(t, fake, "pacman -T make gcc>=10",
+		"/usr/bin/sudo pacman -U --asdeps /cache/gcc-10.1-1-x86_64.pkg.tar.zst")
+}
+
+func TestDepInstallerNothingMissing(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+
+	fetcher := NewMultiFetcher(fakeFetcher{})
+	install := depInstaller(testEscalator(), &fetcher)
+	if err := install(NewCanceler(), []string{"foo"}, []string{"make"}); err != nil {
+		t.Fatalf("install: %s", err)
+	}
+	checkRan(t, fake, "pacman -T make")
+}
+
+func TestDepInstallerNotFound(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["pacman"] = &CmdResult{ExitStatus: 127, Stdout: []byte("nosuchpkg\n")}
+
+	fetcher := NewMultiFetcher(fakeFetcher{})
+	install := depInstaller(testEscalator(), &fetcher)
+	if err := install(NewCanceler(), []string{"foo"}, []string{"nosuchpkg"}); err == nil {
+		t.Errorf("install of a missing dep succeeded")
+	}
+	checkRan(t, fake, "pacman -T nosuchpkg")
+}
+
+// Builds that need the same dep wait for the one install of it.
+func TestDepInstallsShared(t *testing.T) {
+	installs := newDepInstalls()
+	mine, waiting, err := installs.start([]string{"foo"}, []string{"gcc", "cmake"})
+	if err != nil || strings.Join(mine, " ") != "gcc cmake" || len(waiting) != 2 {
+		t.Fatalf("foo: installing %v, waiting for %d, %v", mine, len(waiting), err)
+	}
+	mine2, waiting2, err := installs.start([]string{"bar"}, []string{"zlib", "gcc"})
+	if err != nil || strings.Join(mine2, " ") != "zlib" || len(waiting2) != 2 {
+		t.Fatalf("bar: installing %v, waiting for %d, %v", mine2, len(waiting2), err)
+	}
+	if waiting2["gcc"] != waiting["gcc"] {
+		t.Errorf("bar doesn't wait for foo's install of gcc")
+	}
+
+	installs.finish("gcc", NewFetchError("gcc", "failed"))
+	select {
+	case <-waiting2["gcc"].done:
+		if waiting2["gcc"].err == nil {
+			t.Errorf("bar didn't get the error of the gcc install")
+		}
+	default:
+		t.Errorf("bar is still waiting for gcc")
+	}
+
+	// Once installed, a dep that is missing again is installed again.
+	if mine, _, _ = installs.start([]string{"baz"}, []string{"gcc"}); len(mine) != 1 {
+		t.Errorf("gcc isn't installed again for baz")
+	}
+}
+
+// foo needs gcc and libx, and libx needs gcc too. It waits for the gcc that
+// is installed for foo, which doesn't wait for libx.
+func TestDepInstallerSharedDep(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["pacman -T gcc libx"] = &CmdResult{ExitStatus: 127, Stdout: []byte("gcc\nlibx\n")}
+	fake.Results["pacman -T gcc"] = &CmdResult{ExitStatus: 127, Stdout: []byte("gcc\n")}
+
+	var install DepInstaller
+	var fetcher *MultiFetcher
+	fetcher = NewMultiFetcher(funcFetcher(func(cn *Canceler, pkgname string) ([]string, FetchError) {
+		if pkgname == "libx" {
+			if err := install(cn, []string{"libx"}, []string{"gcc"}); err != nil {
+				return nil, FetchErrorWrap(pkgname, err)
+			}
+		}
+		return []string{"/cache/" + pkgname + "-1.0-1-x86_64.pkg.tar.zst"}, nil
+	}))
+	install = depInstaller(testEscalator(), &fetcher)
+	if err := install(NewCanceler(), []string{"foo"}, []string{"gcc", "libx"}); err != nil {
+		t.Errorf("install: %s", err)
+	}
+}
+
+func TestDepInstallerCycle(t *testing.T) {
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["pacman -T foo"] = &CmdResult{ExitStatus: 127, Stdout: []byte("foo\n")}
+	fake.Results["pacman -T bar"] = &CmdResult{ExitStatus: 127, Stdout: []byte("bar\n")}
+	fake.Results["pacman -T baz"] = &CmdResult{ExitStatus: 127, Stdout: []byte("baz\n")}
+
+	// foo needs bar, which needs baz, which needs foo.
+	needs := map[string]string{"bar": "baz", "baz": "foo"}
+	var install DepInstaller
+	var fetcher *MultiFetcher
+	fetcher = NewMultiFetcher(funcFetcher(func(cn *Canceler, pkgname string) ([]string, FetchError) {
+		if err := install(cn, []string{pkgname}, []string{needs[pkgname]}); err != nil {
+			return nil, FetchErrorWrap(pkgname, err)
+		}
+		return []string{"/cache/" + pkgname + "-1.0-1-x86_64.pkg.tar.zst"}, nil
+	}))
+	install = depInstaller(testEscalator(), &fetcher)
+
+	err := install(NewCanceler(), []string{"foo"}, []string{"bar"})
+	if err == nil || !strings.Contains(err.String(), "dependency cycle") {
+		t.Errorf("install with a dependency cycle: %v", err)
+	}
+	for _, cmdline := range fake.Ran() {
+		if strings.Contains(cmdline, "pacman -U") {
+			t.Errorf("ran %s", cmdline)
+		}
+	}
+
+	// A package that needs itself is a cycle of one.
+	if err = install(NewCanceler(), []string{"foo"}, []string{"foo"}); err == nil {
+		t.Errorf("install of foo for foo succeeded")
+	}
+}
+
+// runSyncInstall of a repo package asks pacman where it is, downloads and
+// checks it, and installs it with pacman -U, all without a real pacman.
+func TestRunSyncInstall(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	pkgfile := "foo-1.0-1-x86_64.pkg.tar.gz"
+	writeBinPkg(t, path.Join(dir, pkgfile), "foo", "1.0-1", "arch = x86_64\n", "usr/bin/foo")
+	data, err := ioutil.ReadFile(path.Join(dir, pkgfile))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	writeSyncDB(t, path.Join(dir, "db"), pkgfile, data)
+	for _, subdir := range []string{"cache", "db/local"} {
+		if err := os.MkdirAll(path.Join(dir, subdir), 0755); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(data)
+	}))
+	defer mirror.Close()
+
+	writePacmanConf(t, dir, "SigLevel = Never\nArchitecture = x86_64\n"+
+		"DBPath = "+path.Join(dir, "db")+"\nCacheDir = "+path.Join(dir, "cache")+"\n"+
+		"RootDir = "+path.Join(dir, "root"), "Server = "+mirror.URL+"/$repo/os/$arch")
+	oldconf := PacmanConfPath
+	PacmanConfPath = path.Join(dir, "pacman.conf")
+	defer func() { PacmanConfPath = oldconf }()
+	for _, env := range []string{"SUDO_USER", "XDG_CACHE_HOME"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("SUDO_USER", "")
+	os.Setenv("XDG_CACHE_HOME", path.Join(dir, "xdg"))
+
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["pacman -S --print --print-format %r %l foo"] = &CmdResult{
+		Stdout: []byte("core " + mirror.URL + "/core/os/x86_64/" + pkgfile + "\n")}
+	// Root builds as somebody else, we build as ourselves.
+	opt := &MawOpt{Action: OptSync, Targets: []string{"foo"}}
+	pkgpath := path.Join(dir, "xdg/maw/pkg", pkgfile)
+	if _, err := NewEscalator(""); err != nil {
+		t.Logf("%s, skipped", err)
+		return
+	}
+	if os.Getuid() == 0 {
+		opt.BuildUser = testNSSUser
+		fake.Results["getent passwd "+testNSSUser] = &CmdResult{Stdout: []byte(
+			testNSSUser + ":*:5001:5000::" + path.Join(dir, "home") + ":/bin/bash\n")}
+		pkgpath = path.Join(dir, "cache", pkgfile)
+	}
+
+	if code := runSyncInstall(NewCanceler(), opt); code != 0 {
+		t.Fatalf("runSyncInstall returned %d", code)
+	}
+	if installed, _ := ioutil.ReadFile(pkgpath); !bytes.Equal(installed, data) {
+		t.Errorf("%s isn't the package", pkgpath)
+	}
+	ran := fake.Ran()
+	if !containsString(ran, "pacman -S --print --print-format %r %l foo") {
+		t.Errorf("didn't ask pacman for foo, ran %v", ran)
+	}
+	if len(ran) == 0 || !strings.HasSuffix(ran[len(ran)-1], "pacman -U "+pkgpath) {
+		t.Errorf("ran %v, want pacman -U %s last", ran, pkgpath)
+	}
+}
@@ -0,0 +1,208 @@
+/*	signature.go
+	OpenPGP signature verification of package files, following the SigLevel
+	settings of pacman.conf.
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"sync"
+	"strings"
+	"crypto/openpgp"
+	"encoding/base64"
+)
+
+const (
+	DefaultGPGDir = "/etc/pacman.d/gnupg/"
+)
+
+type SigLevel int
+
+const (
+	SigRequired SigLevel = iota
+	SigOptional
+	SigNever
+)
+
+// PackageSigLevel returns the signature level for packages of the repo named
+// reponame. Settings in the repo's section override those in [options]. Only
+// the package half of SigLevel matters to us, Database* settings are ignored,
+// as are the Trust* settings (only fully trusted keys are accepted).
+func PackageSigLevel(conf *PacmanConf, reponame string) SigLevel {
+	// Same default as pacman.
+	level := SigRequired
+	if conf == nil {
+		return level
+	}
+
+	sections := []*PacmanSection{conf.Options}
+	if repo := conf.Repo(reponame); repo != nil {
+		sections = append(sections, repo)
+	}
+	for _, sect := range sections {
+		for _, val := range sect.GetAll("SigLevel") {
+			if strings.HasPrefix(val, "Package") {
+				val = val[len("Package"):]
+			}
+			switch val {
+			case "Required":
+				level = SigRequired
+			case "Optional":
+				level = SigOptional
+			case "Never":
+				level = SigNever
+			}
+		}
+	}
+	return level
+}
+
+// KeyringPath returns the path of the public keyring pacman uses, which is
+// inside the GPGDir.
+func KeyringPath(conf *PacmanConf) string {
+	gpgdir := DefaultGPGDir
+	if conf != nil && conf.Options.Get("GPGDir") != "" {
+		gpgdir = conf.Options.Get("GPGDir")
+	}
+	return path.Join(gpgdir, "pubring.gpg")
+}
+
+// SigVerifier checks detached signatures against the keys in a keyring file.
+// Like pacman, it only accepts keys that are valid and fully trusted according
+// to the trustdb next to the keyring: gpg works that out from the ownertrust
+// of the master keys that signed them, and marks revoked and expired keys. The
+// keyring and the validity of its keys are read the first time they are needed.
+type SigVerifier struct {
+	keyringpath string
+	keyring     openpgp.EntityList
+	validity    map[string]string // gpg's validity of each key, by fingerprint
+	lock        sync.Mutex
+}
+
+func NewSigVerifier(keyringpath string) *SigVerifier {
+	return &SigVerifier{keyringpath: keyringpath}
+}
+
+func (sv *SigVerifier) loadKeyring(cn *Canceler) os.Error {
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+
+	if sv.keyring != nil {
+		return nil
+	}
+
+	file, err := os.Open(sv.keyringpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	keyring, err := openpgp.ReadKeyRing(file)
+	if err != nil {
+		return err
+	}
+	validity, err := readKeyValidity(cn, path.Dir(sv.keyringpath))
+	if err != nil {
+		return err
+	}
+	sv.keyring, sv.validity = keyring, validity
+	return nil
+}
+
+// readKeyValidity asks gpg for the validity of the keys in the GPG dir gpgdir,
+// and returns it by the fingerprint of the primary keys. Validities are the
+// letters of gpg's --with-colons output: "f" and "u" are full and ultimate,
+// "r" and "e" revoked and expired, anything else is not trusted.
+func readKeyValidity(cn *Canceler, gpgdir string) (map[string]string, os.Error) {
+	cmd := &Command{Name: "gpg", Args: []string{"--homedir", gpgdir, "--batch",
+		"--lock-never", "--no-auto-check-trustdb", "--with-colons", "--fixed-list-mode",
+		"--list-keys"}, Capture: true, Quiet: true}
+	result, err := CmdRunner.Run(cn, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err = result.Err(cmd); err != nil {
+		return nil, err
+	}
+
+	validity := make(map[string]string)
+	pubvalidity := "" // of the last pub line, whose fpr line comes next
+	for _, line := range strings.Split(string(result.Stdout), "\n") {
+		fields := strings.Split(line, ":")
+		switch {
+		case len(fields) > 1 && fields[0] == "pub":
+			pubvalidity = fields[1]
+		case len(fields) > 9 && fields[0] == "fpr" && pubvalidity != "":
+			validity[strings.ToUpper(fields[9])] = pubvalidity
+			pubvalidity = ""
+		case fields[0] == "sub":
+			pubvalidity = ""
+		}
+	}
+	return validity, nil
+}
+
+// checkTrusted returns an error unless the key of signer is valid and trusted.
+func (sv *SigVerifier) checkTrusted(signer *openpgp.Entity) os.Error {
+	fpr := fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint[:])
+	switch sv.validity[fpr] {
+	case "f", "u":
+		return nil
+	case "r":
+		return os.NewError("the key " + fpr + " has been revoked")
+	case "e":
+		return os.NewError("the key " + fpr + " has expired")
+	}
+	return os.NewError("the key " + fpr + " is not trusted")
+}
+
+// Verify checks that sig is a valid detached signature of the file at
+// filepath, made by a trusted key in our keyring. The signature must be
+// binary, not armored, like pacman's .sig files. The name of the signer is
+// returned.
+func (sv *SigVerifier) Verify(cn *Canceler, filepath string, sig io.Reader) (string, os.Error) {
+	if err := sv.loadKeyring(cn); err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(filepath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	signer, err := openpgp.CheckDetachedSignature(sv.keyring, file, sig)
+	if err == nil {
+		err = sv.checkTrusted(signer)
+	}
+	if err != nil {
+		msg := path.Base(filepath) + " has an invalid signature: " + err.String()
+		return "", os.NewError(msg)
+	}
+
+	for name, _ := range signer.Identities {
+		return name, nil
+	}
+	return "unknown", nil
+}
+
+// VerifyFile is like Verify but reads the signature from sigpath.
+func (sv *SigVerifier) VerifyFile(cn *Canceler, filepath, sigpath string) (string, os.Error) {
+	sigfile, err := os.Open(sigpath)
+	if err != nil {
+		return "", err
+	}
+	defer sigfile.Close()
+	return sv.Verify(cn, filepath, sigfile)
+}
+
+// VerifyBase64 is like Verify but the signature is base64 encoded, as in the
+// PGPSIG field of sync database entries.
+func (sv *SigVerifier) VerifyBase64(cn *Canceler, filepath, sig string) (string, os.Error) {
+	rdr := base64.NewDecoder(base64.StdEncoding, strings.NewReader(sig))
+	return sv.Verify(cn, filepath, rdr)
+}
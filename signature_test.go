@@ -0,0 +1,264 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"http"
+	"path"
+	"time"
+	"bytes"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"crypto/rand"
+	"crypto/openpgp"
+	"http/httptest"
+	"encoding/base64"
+)
+
+func testEntity(t *testing.T, name string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(rand.Reader, time.Seconds(), name, "",
+		strings.Replace(name, " ", ".", -1)+"@example.com")
+	if err != nil {
+		t.Fatalf("NewEntity: %s", err)
+	}
+	return entity
+}
+
+// detachSign returns the binary detached signature of data by signer, like
+// pacman's .sig files.
+func detachSign(t *testing.T, signer *openpgp.Entity, data string) []byte {
+	buf := bytes.NewBuffer(nil)
+	if err := openpgp.DetachSign(buf, signer, strings.NewReader(data)); err != nil {
+		t.Fatalf("DetachSign: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// writeKeyring writes the public keys of entities to a keyring at keyringpath.
+func writeKeyring(t *testing.T, keyringpath string, entities ...*openpgp.Entity) {
+	file, err := os.Create(keyringpath)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer file.Close()
+	for _, entity := range entities {
+		if err = entity.Serialize(file); err != nil {
+			t.Fatalf("Serialize: %s", err)
+		}
+	}
+}
+
+// fakeValidity makes gpg, faked by fake, list the keys of entities with
+// gpg's validity letters, like pacman-key would have left them in the trustdb.
+func fakeValidity(fake *FakeRunner, entities map[*openpgp.Entity]string) {
+	out := "tru::1:1300000000:0:3:1:5\n"
+	for entity, validity := range entities {
+		out += fmt.Sprintf("pub:%s:2048:1:%X:1300000000:::-:::scSC:\n", validity,
+			entity.PrimaryKey.Fingerprint[12:])
+		out += fmt.Sprintf("fpr:::::::::%X:\n", entity.PrimaryKey.Fingerprint[:])
+		out += "uid:" + validity + "::::1300000000::ABCD::maw key:\n"
+	}
+	fake.Results["gpg"] = &CmdResult{Stdout: []byte(out)}
+}
+
+// writePacmanConf writes a pacman.conf to dir with the options text in
+// [options] and a [core] repo, and reads it back.
+func writePacmanConf(t *testing.T, dir, options, core string) *PacmanConf {
+	confpath := path.Join(dir, "pacman.conf")
+	text := "[options]\n" + options + "\n[core]\n" + core + "\n"
+	if err := ioutil.WriteFile(confpath, []byte(text), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	conf, err := ReadPacmanConf(confpath)
+	if err != nil {
+		t.Fatalf("ReadPacmanConf: %s", err)
+	}
+	return conf
+}
+
+func TestPackageSigLevel(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		options, core string
+		want          SigLevel
+	}{
+		{"", "", SigRequired},
+		{"SigLevel = Never", "", SigNever},
+		{"SigLevel = Optional TrustedOnly", "", SigOptional},
+		{"SigLevel = PackageOptional DatabaseNever", "", SigOptional},
+		{"SigLevel = DatabaseNever", "", SigRequired},
+		{"SigLevel = Never", "SigLevel = PackageRequired", SigRequired},
+		{"SigLevel = Required", "SigLevel = Optional", SigOptional},
+	}
+	for _, test := range tests {
+		conf := writePacmanConf(t, dir, test.options, test.core)
+		if level := PackageSigLevel(conf, "core"); level != test.want {
+			t.Errorf("%q, %q: got SigLevel %d, want %d", test.options, test.core,
+				level, test.want)
+		}
+	}
+	if level := PackageSigLevel(nil, "core"); level != SigRequired {
+		t.Errorf("got SigLevel %d without pacman.conf, want SigRequired", level)
+	}
+}
+
+// The signatures checkSignature is tested with. Signatures are served by the
+// mirror, or put in the sync database if indb is true.
+var sigTests = []struct {
+	name string
+	indb bool
+	ok   map[SigLevel]bool // if the signature is accepted at each level
+}{
+	{"good", false, map[SigLevel]bool{SigRequired: true, SigOptional: true, SigNever: true}},
+	{"bad", false, map[SigLevel]bool{SigNever: true}},
+	{"unknown key", false, map[SigLevel]bool{SigNever: true}},
+	{"missing", false, map[SigLevel]bool{SigOptional: true, SigNever: true}},
+	{"good", true, map[SigLevel]bool{SigRequired: true, SigOptional: true, SigNever: true}},
+	{"bad", true, map[SigLevel]bool{SigNever: true}},
+	{"unknown key", true, map[SigLevel]bool{SigNever: true}},
+}
+
+func TestCheckSignature(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	pkgpath := path.Join(dir, testPkgFilename)
+	if err := ioutil.WriteFile(pkgpath, []byte(testPkgContent), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	packager := testEntity(t, "maw packager")
+	stranger := testEntity(t, "maw stranger")
+	writeKeyring(t, path.Join(dir, "pubring.gpg"), packager)
+	fake, restore := useFakeRunner()
+	defer restore()
+	fakeValidity(fake, map[*openpgp.Entity]string{packager: "f"})
+	sigs := map[string][]byte{
+		"good":        detachSign(t, packager, testPkgContent),
+		"bad":         detachSign(t, packager, testPkgContent+"tampered"),
+		"unknown key": detachSign(t, stranger, testPkgContent),
+	}
+
+	// The mirror serves the signature of the current test, if it has one.
+	var served []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if served == nil || req.URL.Path != "/"+testPkgFilename+".sig" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(served)
+	}))
+	defer server.Close()
+	mirrorurl := server.URL + "/" + testPkgFilename
+
+	levels := map[SigLevel]string{SigRequired: "Required", SigOptional: "Optional",
+		SigNever: "Never"}
+	for level, levelname := range levels {
+		conf := writePacmanConf(t, dir, "SigLevel = "+levelname+"\nGPGDir = "+dir, "")
+		for _, test := range sigTests {
+			desc := PkgDesc{"FILENAME": []string{testPkgFilename}}
+			served = nil
+			if test.indb {
+				desc["PGPSIG"] = []string{base64.StdEncoding.EncodeToString(sigs[test.name])}
+			} else {
+				served = sigs[test.name]
+			}
+
+			pf := &PacmanFetcher{pkgdest: dir, conf: conf,
+				verifier: NewSigVerifier(KeyringPath(conf))}
+			err := pf.checkSignature(NewCanceler(), "core", desc, mirrorurl, pkgpath)
+			name := fmt.Sprintf("%s: %s signature", levelname, test.name)
+			if test.indb {
+				name += " in the sync database"
+			}
+			switch {
+			case test.ok[level] && err != nil:
+				t.Errorf("%s: %s", name, err)
+			case !test.ok[level] && err == nil:
+				t.Errorf("%s: accepted", name)
+			}
+			os.Remove(pkgpath + ".sig")
+		}
+	}
+}
+
+func TestVerifySigner(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	pkgpath := path.Join(dir, testPkgFilename)
+	if err := ioutil.WriteFile(pkgpath, []byte(testPkgContent), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	packager := testEntity(t, "maw packager")
+	writeKeyring(t, path.Join(dir, "pubring.gpg"), packager)
+	fake, restore := useFakeRunner()
+	defer restore()
+	fakeValidity(fake, map[*openpgp.Entity]string{packager: "u"})
+
+	sv := NewSigVerifier(path.Join(dir, "pubring.gpg"))
+	sig := detachSign(t, packager, testPkgContent)
+	signer, err := sv.Verify(NewCanceler(), pkgpath, bytes.NewBuffer(sig))
+	if err != nil {
+		t.Fatalf("Verify: %s", err)
+	}
+	if !strings.HasPrefix(signer, "maw packager") {
+		t.Errorf("signed by %q, want the maw packager", signer)
+	}
+
+	// A keyring that isn't there is an error, not an unsigned package.
+	sv = NewSigVerifier(path.Join(dir, "nosuchring.gpg"))
+	if _, err := sv.Verify(NewCanceler(), pkgpath, bytes.NewBuffer(sig)); err == nil {
+		t.Errorf("Verify without a keyring succeeded")
+	}
+}
+
+// Keys in the keyring are only good enough if gpg says they are valid and
+// fully trusted.
+func TestVerifyTrust(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	pkgpath := path.Join(dir, testPkgFilename)
+	if err := ioutil.WriteFile(pkgpath, []byte(testPkgContent), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	keyringpath := path.Join(dir, "pubring.gpg")
+
+	tests := []struct {
+		validity string // "" for a key gpg doesn't list
+		ok       bool
+	}{
+		{"f", true},
+		{"u", true},
+		{"r", false},
+		{"e", false},
+		{"m", false},
+		{"q", false},
+		{"-", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		packager := testEntity(t, "maw packager")
+		writeKeyring(t, keyringpath, packager)
+		fake, restore := useFakeRunner()
+		validity := map[*openpgp.Entity]string{testEntity(t, "maw other"): "f"}
+		if test.validity != "" {
+			validity[packager] = test.validity
+		}
+		fakeValidity(fake, validity)
+
+		sv := NewSigVerifier(keyringpath)
+		sig := detachSign(t, packager, testPkgContent)
+		_, err := sv.Verify(NewCanceler(), pkgpath, bytes.NewBuffer(sig))
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("validity %q: %s", test.validity, err)
+		case !test.ok && err == nil:
+			t.Errorf("validity %q: accepted", test.validity)
+		}
+		checkRan(t, fake, "gpg --homedir "+dir+" --batch --lock-never --no-auto-check-trustdb "+
+			"--with-colons --fixed-list-mode --list-keys")
+		restore()
+	}
+}
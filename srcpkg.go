@@ -12,46 +12,51 @@ import (
 	"os"
 	"fmt"
 	"path"
-	"exec"
-	"bufio"
 	"strings"
+	"time"
+	"unsafe"
 	"syscall"
-	"io/ioutil"
 	"archive/tar"
-	"compress/gzip"
 )
 
 const (
-	MawMakepkgPath = "/usr/bin/mawmakepkg"
+	MakepkgPath = "/usr/bin/makepkg" // the default, see DefaultCmdPaths
 )
 
-type SrcPkg struct {
-	path     string
-	file     *os.File
-	unzipper *gzip.Decompressor
-	reader   *tar.Reader
-}
+// Limits on what we extract from source packages, against decompression bombs.
+const (
+	MaxSrcFileSize = 64 << 20  // bytes, for any one file
+	MaxSrcPkgSize  = 256 << 20 // bytes, for all files together
+	SrcPkgModeMask = 0755      // permission bits kept from the tarball
+)
 
-func OpenSrcPkg(path string) (*SrcPkg, os.Error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// maxFileTime is the largest time_t of the platform, in seconds. On 64-bit
+// systems it is the largest time we can pass to NsecToTimeval instead.
+var maxFileTime int64 = func() int64 {
+	var tv syscall.Timeval
+	if unsafe.Sizeof(tv.Sec) < 8 {
+		return 1<<31 - 1
 	}
+	return (1<<63 - 1) / 1000000000
+}()
 
-	unzipper, err := gzip.NewReader(file)
+type SrcPkg struct {
+	path    string
+	tarball *Tarball
+}
+
+// OpenSrcPkg opens the source package at path. If a decompressor command has to
+// be run for it, it is killed when cn is canceled.
+func OpenSrcPkg(cn *Canceler, path string) (*SrcPkg, os.Error) {
+	tarball, err := OpenTarball(cn, path)
 	if err != nil {
-		file.Close()
 		return nil, err
 	}
-
-	reader := tar.NewReader(unzipper)
-
-	return &SrcPkg{path, file, unzipper, reader}, nil
+	return &SrcPkg{path, tarball}, nil
 }
 
 func (srcpkg *SrcPkg) Close() {
-	srcpkg.unzipper.Close()
-	srcpkg.file.Close()
+	srcpkg.tarball.Close()
 }
 
 // PackageName extracts the name of the package from the path of the source package
@@ -67,12 +72,13 @@ func (srcpkg *SrcPkg) PackageName() (string, os.Error) {
 }
 
 // Extract extracts the source directory from the SrcPkg into the specified
-// destination directory.
+// destination directory. Everything in the source package must be inside the
+// package dir. Subdirectories are fine, and so are symlinks, as long as they
+// are relative and point inside the package dir. Hard links, device nodes and
+// the like are refused.
 //
 // str1ng's goarchive (https://github.com/str1ngs/goarchive) was used as a
 // starting point for this code and associated functions.
-//
-// TODO: do package checking first, maybe with a Check method.
 func (srcpkg *SrcPkg) Extract(destdir string) (string, os.Error) {
 	dirname, err := srcpkg.PackageName()
 	if err != nil {
@@ -83,7 +89,8 @@ func (srcpkg *SrcPkg) Extract(destdir string) (string, os.Error) {
 	defer syscall.Umask(oldmask)
 
 	destpkgdir := path.Join(destdir, dirname)
-	rdr := srcpkg.reader
+	rdr := srcpkg.tarball
+	var extracted int64 // total size of the files so far
 	for {
 		hdr, err := rdr.Next()
 		if err == os.EOF {
@@ -93,39 +100,172 @@ func (srcpkg *SrcPkg) Extract(destdir string) (string, os.Error) {
 			return "", err
 		}
 
+		relpath, err := entryPath(hdr.Name, dirname)
+		if err != nil {
+			return "", err
+		}
+		newpath := path.Join(destpkgdir, relpath)
+
 		switch hdr.Typeflag {
 		case tar.TypeDir:
-			if tardir := strings.TrimRight(hdr.Name, "/"); tardir != dirname {
-				msg := "Tarball dir (" + hdr.Name + ") should be " + dirname
-				return "", os.NewError(msg)
+			err = prepPath(destpkgdir, relpath)
+			if err == nil && relpath != "" {
+				err = prepDirectory(newpath)
 			}
-			if err := prepDirectory(destpkgdir); err != nil {
-				return "", err
+		case tar.TypeSymlink:
+			if err = checkLinkTarget(destpkgdir, relpath, hdr.Linkname); err != nil {
+				break
 			}
-		case tar.TypeSymlink, tar.TypeLink:
-			msg := "Links were found inside the source package, aborting."
-			return "", os.NewError(msg)
+			if err = prepPath(destpkgdir, relpath); err != nil {
+				break
+			}
+			if err = removeNonDir(newpath); err != nil {
+				break
+			}
+			err = os.Symlink(hdr.Linkname, newpath)
 		case tar.TypeReg, tar.TypeRegA:
-			dir, filename := path.Split(hdr.Name)
-			dir = strings.TrimRight(dir, "/")
-			if dir != dirname {
-				tmp := "File (%s) in source package is not contained " +
-					"in the package dir (%s)"
-				errstr := fmt.Sprintf(tmp, hdr.Name, dirname)
-				return "", os.NewError(errstr)
+			if relpath == "" {
+				return "", os.NewError("File in source package has the name of the package dir")
+			}
+			if err = prepPath(destpkgdir, relpath); err != nil {
+				break
 			}
-			srcpkg.extractFile(path.Join(destpkgdir, filename), hdr)
+			// Don't write through a symlink we extracted before.
+			if err = removeNonDir(newpath); err != nil {
+				break
+			}
+			if hdr.Size < 0 || hdr.Size > MaxSrcFileSize {
+				return "", os.NewError(fmt.Sprintf("File (%s) in source package is too big (%d bytes)",
+					hdr.Name, hdr.Size))
+			}
+			if extracted += hdr.Size; extracted > MaxSrcPkgSize {
+				return "", os.NewError(fmt.Sprintf("Source package is bigger than %d bytes when extracted",
+					MaxSrcPkgSize))
+			}
+			err = srcpkg.extractFile(newpath, hdr)
+		case tar.TypeLink:
+			return "", os.NewError("Hard link (" + hdr.Name + ") found inside the source package, aborting.")
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			return "", os.NewError("Device or fifo (" + hdr.Name + ") found inside the source package, aborting.")
 		default:
 			return "", os.NewError("Invalid tar header type")
 		}
+		if err != nil {
+			return "", err
+		}
 	}
 
 	return destpkgdir, nil
 }
 
-// prepDirectory creates a new directory unless one already exists.
+// entryPath checks that name, the name of an entry in the source package, is
+// inside the package dir dirname and returns its path relative to dirname.
+// The package dir itself is "".
+func entryPath(name, dirname string) (string, os.Error) {
+	if strings.HasPrefix(name, "/") {
+		return "", os.NewError("Absolute path (" + name + ") in source package")
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", os.NewError("Path (" + name + ") in source package leads outside of it")
+		}
+	}
+
+	cleaned := path.Clean(name)
+	if cleaned == dirname {
+		return "", nil
+	}
+	if !strings.HasPrefix(cleaned, dirname+"/") {
+		tmp := "File (%s) in source package is not contained " +
+			"in the package dir (%s)"
+		return "", os.NewError(fmt.Sprintf(tmp, name, dirname))
+	}
+	return cleaned[len(dirname)+1:], nil
+}
+
+// checkLinkTarget checks that the symlink at relpath (relative to the package
+// dir pkgdir) pointing to linkname stays inside the package dir. Lexically, and
+// also after following what was extracted so far: the kernel resolves ".."
+// after a symlink from the symlink's target, not from where the symlink is.
+// So the target may not go through a symlink, and a ".." must come after
+// dirs that exist. The dirs leading up to relpath are real, prepPath makes
+// sure of that.
+func checkLinkTarget(pkgdir, relpath, linkname string) os.Error {
+	if relpath == "" {
+		return os.NewError("Symlink in source package has the name of the package dir")
+	}
+	if linkname == "" || strings.HasPrefix(linkname, "/") {
+		return os.NewError("Symlink (" + relpath + ") in source package is not relative")
+	}
+	target := path.Clean(path.Join(path.Dir(relpath), linkname))
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return os.NewError("Symlink (" + relpath + " -> " + linkname +
+			") in source package points outside of it")
+	}
+
+	// real is true as long as dir is known to be a dir and not a symlink.
+	dir, real := path.Dir(relpath), true
+	parts := strings.Split(linkname, "/")
+	for i, part := range parts {
+		switch {
+		case part == "" || part == ".":
+			continue
+		case part == ".." && !real:
+			return os.NewError("Symlink (" + relpath + " -> " + linkname +
+				") in source package goes back up from a symlink or unknown dir")
+		case part == "..":
+			dir = path.Dir(dir)
+			continue
+		}
+
+		dir = path.Join(dir, part)
+		stat, err := os.Lstat(path.Join(pkgdir, dir))
+		switch {
+		case err == nil && stat.IsSymlink() && i < len(parts)-1:
+			return os.NewError("Symlink (" + relpath + " -> " + linkname +
+				") in source package goes through the symlink " + dir)
+		case err != nil || !stat.IsDirectory():
+			real = false
+		}
+	}
+	return nil
+}
+
+// prepPath creates the package dir pkgdir and the directories inside it that
+// lead up to relpath. None of them may be a symlink, so that nothing can be
+// written outside of pkgdir.
+func prepPath(pkgdir, relpath string) os.Error {
+	dir := pkgdir
+	if err := prepDirectory(dir); err != nil {
+		return err
+	}
+	parts := strings.Split(relpath, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = path.Join(dir, part)
+		if err := prepDirectory(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeNonDir removes whatever is at filepath, unless it is a directory.
+func removeNonDir(filepath string) os.Error {
+	stat, err := os.Lstat(filepath)
+	if err != nil {
+		// Nothing to remove.
+		return nil
+	}
+	if stat.IsDirectory() {
+		return os.NewError(filepath + " already exists as a directory")
+	}
+	return os.Remove(filepath)
+}
+
+// prepDirectory creates a new directory unless one already exists. A symlink to
+// a directory doesn't count.
 func prepDirectory(newpath string) os.Error {
-	switch stat, err := os.Stat(newpath); {
+	switch stat, err := os.Lstat(newpath); {
 	case err == nil:
 		// If directory already exists that's cool, too.
 		if stat.IsDirectory() {
@@ -143,35 +283,74 @@ func prepDirectory(newpath string) os.Error {
 }
 
 // extractFile is a helper function for Extract which extracts a file and
-// matches the new file's mtime and atime to the original archive entry.
+// matches the new file's permissions, mtime and atime to the original archive
+// entry. Only the rwx bits are kept and nobody but the owner may write.
 func (srcpkg *SrcPkg) extractFile(newpath string, hdr *tar.Header) os.Error {
 	file, err := os.Create(newpath)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(file, srcpkg.reader)
+	// The tar reader won't give us more than hdr.Size bytes.
+	_, err = io.Copy(file, srcpkg.tarball)
+	if err == nil {
+		err = file.Chmod(uint32(hdr.Mode) & SrcPkgModeMask)
+	}
 	file.Close()
 	if err != nil {
 		return err
 	}
 
-	ubuf := &syscall.Utimbuf{int32(hdr.Atime), int32(hdr.Mtime)}
-	if errno := syscall.Utime(newpath, ubuf); errno != 0 {
-		return os.NewError("Failed to set modification time for " + newpath)
+	return setFileTimes(newpath, hdr.Atime, hdr.Mtime)
+}
+
+// setFileTimes sets the atime and mtime (in seconds) of the file at filepath.
+// Times before 1970 or too large for the platform's time_t are clamped. A
+// missing atime is taken to be the same as the mtime.
+func setFileTimes(filepath string, atime, mtime int64) os.Error {
+	mtime = clampFileTime(mtime)
+	if atime == 0 {
+		atime = mtime
 	}
+	atime = clampFileTime(atime)
 
+	tv := []syscall.Timeval{syscall.NsecToTimeval(atime * 1e9),
+		syscall.NsecToTimeval(mtime * 1e9)}
+	if errno := syscall.Utimes(filepath, tv); errno != 0 {
+		return os.NewError("Failed to set modification time for " + filepath +
+			": " + os.Errno(errno).String())
+	}
 	return nil
 }
 
+func clampFileTime(secs int64) int64 {
+	switch {
+	case secs < 0:
+		return 0
+	case secs > maxFileTime:
+		return maxFileTime
+	}
+	return secs
+}
+
 //////////////////////////////////////////////////////////////////////////////
 
+// DepInstaller installs the dependencies in deps (specs like "foo>=1.0") that
+// aren't installed yet. pkgnames are the packages that are built with them.
+type DepInstaller func(cn *Canceler, pkgnames, deps []string) os.Error
+
+// PackageBuilder is the Builder which runs makepkg right on the host. makepkg
+// is run as the build user, if there is one. The build user can't install
+// anything, so missing dependencies are installed with installDeps first.
 type PackageBuilder struct {
-	customLevel int //unimplemented
+	user        *BuildUser
+	installDeps DepInstaller
 }
 
-func NewPackageBuilder() *PackageBuilder {
-	return &PackageBuilder{}
+// NewPackageBuilder returns a PackageBuilder which builds as user. installDeps
+// may be nil, in which case makepkg fails if dependencies are missing.
+func NewPackageBuilder(user *BuildUser, installDeps DepInstaller) *PackageBuilder {
+	return &PackageBuilder{user, installDeps}
 }
 
 func isDirectory(dirpath string) bool {
@@ -182,92 +361,100 @@ func isDirectory(dirpath string) bool {
 	return true
 }
 
-// Build runs makepkg on the specified srcdir. A slice of package paths are
-// returned. These are the paths to the binary packages that are built. Packages
-// with multiple pkgnames build multiple packages, hence the use of a slice.
-// If an error occurs, returns nil and the error.
+// Build runs makepkg on the specified srcdir. The paths to the binary packages
+// that are built are returned in the result. Packages with multiple pkgnames
+// build multiple packages, hence the use of a slice. makepkg logs the build to
+// files in srcdir, their paths are in the result as well.
 //
 // Notice that we do not actually set PKGDEST ourselves, this should be done
 // before calling this function. Otherwise the built package will just end up
 // in the package source directory. Maybe.
-func (builder *PackageBuilder) Build(srcdir string) ([]string, os.Error) {
-	// Create a tempfile and hook it into our bash tomfoolery.
-	pathfile, err := NewPkgPathFile()
+//
+// If cn is canceled, makepkg is killed and ErrCanceled is returned.
+func (builder *PackageBuilder) Build(cn *Canceler, srcdir string) (*BuildResult, os.Error) {
+	if cn.Canceled() {
+		return nil, ErrCanceled
+	}
+
+	if builder.installDeps != nil {
+		vars, err := ReadPkgbuildVars(srcdir)
+		if err != nil {
+			return nil, err
+		}
+		if deps := BuildDeps(vars, machineArch()); len(deps) > 0 {
+			if err = builder.installDeps(cn, vars["pkgname"], deps); err != nil {
+				return nil, err
+			}
+		}
+	}
+	env := builder.user.Environ()
+
+	// Ask makepkg which package files it is going to build before building them.
+	pkgpaths, err := listPackages(cn, builder.user, srcdir, env)
 	if err != nil {
 		return nil, err
 	}
-	defer pathfile.Cleanup()
 
-	// Call our included utility, mawmakepkg which wraps makepkg to drop priveledges
-	// and print the paths of built packages to our tempfile.
-	args := []string{MawMakepkgPath, pathfile.Name(), "-s", "-m", "-f"}
-	cmd, err := exec.Run(MawMakepkgPath, args, nil, srcdir,
-		exec.PassThrough, exec.PassThrough, exec.PassThrough)
+	started := time.Seconds()
+	cmd := &Command{Name: "makepkg", Args: []string{"-m", "-f", "-L"},
+		Dir: srcdir, User: builder.user, Env: env}
+	cmdresult, err := CmdRunner.Run(cn, cmd)
 	if err != nil {
 		return nil, err
 	}
-	defer cmd.Process.Release()
-
-	waitmsg, err := cmd.Wait(0)
-	if code := waitmsg.ExitStatus(); code != 0 {
-		return nil, os.NewError("makepkg failed")
+	result := &BuildResult{nil, findBuildLogs(srcdir, started)}
+	if err = cmdresult.Err(cmd); err != nil {
+		return result, err
 	}
 
-	return pathfile.ReadLines()
-}
-
-type PkgPathFile struct {
-	file *os.File
-	path string
+	if result.PkgPaths, err = verifyBuilt(pkgpaths); err != nil {
+		return result, err
+	}
+	return result, nil
 }
 
-func NewPkgPathFile() (*PkgPathFile, os.Error) {
-	tmpfile, err := ioutil.TempFile("", "maw")
+// listPackages runs makepkg --packagelist in srcdir as user and returns the
+// paths of the package files makepkg would build.
+func listPackages(cn *Canceler, user *BuildUser, srcdir string, env []string) ([]string, os.Error) {
+	cmd := &Command{Name: "makepkg", Args: []string{"--packagelist"},
+		Dir: srcdir, User: user, Env: env, Capture: true}
+	result, err := CmdRunner.Run(cn, cmd)
 	if err != nil {
 		return nil, err
 	}
-	pathfile := &PkgPathFile{tmpfile, tmpfile.Name()}
-
-	// If we are running under sudo, we must chmod the tempfile to the user
-	// whom we are going to be dropping privledges to (the SUDO_USER).
-	uid, gid := lookupSudoUser()
-	if uid == 0 {
-		return pathfile, nil
+	if err = result.Err(cmd); err != nil {
+		return nil, err
 	}
-	tmpfile.Chown(uid, gid)
-	return pathfile, nil
-}
-
-func (ppfile *PkgPathFile) Name() string {
-	return ppfile.file.Name()
-}
 
-func (ppfile *PkgPathFile) Cleanup() {
-	ppfile.file.Close()
-	os.Remove(ppfile.path)
+	pkgpaths := make([]string, 0, 4)
+	for _, line := range strings.Split(string(result.Stdout), "\n") {
+		if line != "" {
+			pkgpaths = append(pkgpaths, line)
+		}
+	}
+	return pkgpaths, nil
 }
 
-func (ppfile *PkgPathFile) ReadLines() ([]string, os.Error) {
-	// Read our sneaky tempfile. It contains the names of package files
-	// that were built by makepkg.
-	pkgpaths := make([]string, 0, 32)
-
-	// Use bufio to read one line/path at a time.
-	reader := bufio.NewReader(ppfile.file)
-ResultLoop:
-	for {
-		line, prefix, err := reader.ReadLine()
-		switch {
-		default:
-			pkgpaths = append(pkgpaths, string(line))
-		case prefix:
-			return nil, os.NewError("Extremely long line for package path")
-		case err == os.EOF:
-			break ResultLoop
-		case err != nil:
-			return nil, err
+// verifyBuilt checks that makepkg really did build the package files it said
+// it would build, and returns the ones that exist. makepkg lists a -debug
+// package whenever debug packages are enabled, but only builds it if there
+// were debug symbols to put in it, so a missing -debug package is fine.
+func verifyBuilt(pkgpaths []string) ([]string, os.Error) {
+	if len(pkgpaths) == 0 {
+		return nil, os.NewError("makepkg did not list any packages to build")
+	}
+	built := make([]string, 0, len(pkgpaths))
+	for _, pkgpath := range pkgpaths {
+		stat, err := os.Stat(pkgpath)
+		if err == nil && stat.IsRegular() && stat.Size > 0 {
+			built = append(built, pkgpath)
+			continue
 		}
+		pkgname, _ := parsePkgFilename(path.Base(pkgpath))
+		if err != nil && strings.HasSuffix(pkgname, "-debug") {
+			continue
+		}
+		return nil, os.NewError("makepkg did not build " + pkgpath)
 	}
-
-	return pkgpaths, nil
+	return built, nil
 }
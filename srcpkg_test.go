@@ -0,0 +1,287 @@
+package main
+
+import (
+	"os"
+	"path"
+	"unsafe"
+	"syscall"
+	"testing"
+	"io/ioutil"
+	"archive/tar"
+)
+
+var pkgbuildEntry = tarEntry{Name: "foo/PKGBUILD", Body: "pkgname=foo\n"}
+
+// Source packages for the package dir foo, and if Extract should accept them.
+// Whatever happens, nothing may be written outside of foo.
+var extractTests = []struct {
+	name    string
+	entries []tarEntry
+	ok      bool
+}{
+	{"plain", []tarEntry{{Name: "foo/", Typeflag: tar.TypeDir}, pkgbuildEntry}, true},
+	{"no dir entry", []tarEntry{pkgbuildEntry}, true},
+	{"subdirs", []tarEntry{pkgbuildEntry,
+		{Name: "foo/patches/", Typeflag: tar.TypeDir},
+		{Name: "foo/patches/fix.patch", Body: "patch"},
+		{Name: "foo/keys/pgp/ABCD.asc", Body: "key"}}, true},
+	{"contained symlinks", []tarEntry{pkgbuildEntry,
+		{Name: "foo/patches/fix.patch", Body: "patch"},
+		{Name: "foo/fix.patch", Typeflag: tar.TypeSymlink, Linkname: "patches/fix.patch"},
+		{Name: "foo/patches/up", Typeflag: tar.TypeSymlink, Linkname: "../PKGBUILD"}}, true},
+
+	{"dot dot", []tarEntry{pkgbuildEntry, {Name: "foo/../evil", Body: "x"}}, false},
+	{"leading dot dot", []tarEntry{{Name: "../evil", Body: "x"}}, false},
+	{"dot dot in subdir", []tarEntry{{Name: "foo/a/../../evil", Body: "x"}}, false},
+	{"absolute path", []tarEntry{{Name: "/tmp/maw-test-evil", Body: "x"}}, false},
+	{"outside the package dir", []tarEntry{pkgbuildEntry, {Name: "bar/evil", Body: "x"}}, false},
+	{"file named like the package dir", []tarEntry{{Name: "foo", Body: "x"}}, false},
+	{"absolute symlink", []tarEntry{{Name: "foo/passwd", Typeflag: tar.TypeSymlink,
+		Linkname: "/etc/passwd"}}, false},
+	{"escaping symlink", []tarEntry{{Name: "foo/up", Typeflag: tar.TypeSymlink,
+		Linkname: "../.."}}, false},
+	{"escaping symlink in subdir", []tarEntry{{Name: "foo/a/b/up", Typeflag: tar.TypeSymlink,
+		Linkname: "../../../evil"}}, false},
+	{"symlink named like the package dir", []tarEntry{{Name: "foo", Typeflag: tar.TypeSymlink,
+		Linkname: "."}}, false},
+	{"write through a symlinked dir", []tarEntry{pkgbuildEntry,
+		{Name: "foo/sub/", Typeflag: tar.TypeDir},
+		{Name: "foo/link", Typeflag: tar.TypeSymlink, Linkname: "sub"},
+		{Name: "foo/link/evil", Body: "x"}}, false},
+	{"dot dot after a symlink", []tarEntry{pkgbuildEntry,
+		{Name: "foo/d/l", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "foo/x", Typeflag: tar.TypeSymlink, Linkname: "d/l/.."},
+		{Name: "foo/x/evil", Body: "x"}}, false},
+	{"hard link", []tarEntry{pkgbuildEntry, {Name: "foo/hard", Typeflag: tar.TypeLink,
+		Linkname: "foo/PKGBUILD"}}, false},
+	{"hard link outside", []tarEntry{{Name: "foo/shadow", Typeflag: tar.TypeLink,
+		Linkname: "/etc/shadow"}}, false},
+	{"char device", []tarEntry{{Name: "foo/null", Typeflag: tar.TypeChar}}, false},
+	{"block device", []tarEntry{{Name: "foo/sda", Typeflag: tar.TypeBlock}}, false},
+	{"fifo", []tarEntry{{Name: "foo/fifo", Typeflag: tar.TypeFifo}}, false},
+}
+
+// extractTestPkg writes a source package of entries into a new temp dir and
+// extracts it into the dir dest in there. The temp dir is returned.
+func extractTestPkg(t *testing.T, entries []tarEntry) (string, os.Error) {
+	dir := tempDir(t)
+	srcpath := path.Join(dir, "foo.src.tar.gz")
+	writeTarball(t, srcpath, entries)
+	if err := os.Mkdir(path.Join(dir, "dest"), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	srcpkg, err := OpenSrcPkg(NewCanceler(), srcpath)
+	if err != nil {
+		t.Fatalf("OpenSrcPkg: %s", err)
+	}
+	defer srcpkg.Close()
+	_, err = srcpkg.Extract(path.Join(dir, "dest"))
+	return dir, err
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	names, err := readDirNames(dir)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return names
+}
+
+func TestExtract(t *testing.T) {
+	for _, test := range extractTests {
+		dir, err := extractTestPkg(t, test.entries)
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case !test.ok && err == nil:
+			t.Errorf("%s: extracted without error", test.name)
+		}
+
+		if names := dirNames(t, dir); len(names) != 2 {
+			t.Errorf("%s: wrote outside of the dest dir: %v", test.name, names)
+		}
+		names := dirNames(t, path.Join(dir, "dest"))
+		if len(names) > 1 || (len(names) == 1 && names[0] != "foo") {
+			t.Errorf("%s: wrote outside of the package dir: %v", test.name, names)
+		}
+		if _, err := os.Lstat("/tmp/maw-test-evil"); err == nil {
+			t.Errorf("%s: wrote to an absolute path", test.name)
+			os.Remove("/tmp/maw-test-evil")
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExtractContents(t *testing.T) {
+	dir, err := extractTestPkg(t, []tarEntry{pkgbuildEntry,
+		{Name: "foo/patches/fix.patch", Body: "patch"},
+		{Name: "foo/fix.patch", Typeflag: tar.TypeSymlink, Linkname: "patches/fix.patch"}})
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatalf("Extract: %s", err)
+	}
+
+	pkgdir := path.Join(dir, "dest", "foo")
+	if data, err := ioutil.ReadFile(path.Join(pkgdir, "patches", "fix.patch")); err != nil ||
+		string(data) != "patch" {
+		t.Errorf("patches/fix.patch = %q, %v", data, err)
+	}
+	if link, err := os.Readlink(path.Join(pkgdir, "fix.patch")); err != nil ||
+		link != "patches/fix.patch" {
+		t.Errorf("fix.patch links to %q, %v", link, err)
+	}
+}
+
+// A file entry after a symlink of the same name replaces the symlink, instead
+// of writing to what it points to.
+func TestExtractReplacesSymlink(t *testing.T) {
+	dir, err := extractTestPkg(t, []tarEntry{pkgbuildEntry,
+		{Name: "foo/link", Typeflag: tar.TypeSymlink, Linkname: "PKGBUILD"},
+		{Name: "foo/link", Body: "replaced"}})
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatalf("Extract: %s", err)
+	}
+
+	pkgdir := path.Join(dir, "dest", "foo")
+	if data, _ := ioutil.ReadFile(path.Join(pkgdir, "PKGBUILD")); string(data) != "pkgname=foo\n" {
+		t.Errorf("PKGBUILD was written through the symlink: %q", data)
+	}
+	stat, err := os.Lstat(path.Join(pkgdir, "link"))
+	if err != nil || !stat.IsRegular() {
+		t.Errorf("link was not replaced by a regular file")
+	}
+}
+
+func TestEntryPath(t *testing.T) {
+	tests := []struct {
+		name, relpath string
+		ok            bool
+	}{
+		{"foo", "", true},
+		{"foo/", "", true},
+		{"foo/PKGBUILD", "PKGBUILD", true},
+		{"foo/./a//b", "a/b", true},
+		{"foo/../foo/PKGBUILD", "", false},
+		{"/foo/PKGBUILD", "", false},
+		{"foobar/PKGBUILD", "", false},
+		{"PKGBUILD", "", false},
+	}
+	for _, test := range tests {
+		relpath, err := entryPath(test.name, "foo")
+		if (err == nil) != test.ok || relpath != test.relpath {
+			t.Errorf("entryPath(%q) = %q, %v", test.name, relpath, err)
+		}
+	}
+}
+
+func TestCheckLinkTarget(t *testing.T) {
+	// The package dir has the dir a/b and the symlink d/l to it.
+	pkgdir := tempDir(t)
+	defer os.RemoveAll(pkgdir)
+	if err := os.MkdirAll(path.Join(pkgdir, "a/b"), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.Mkdir(path.Join(pkgdir, "d"), 0755); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.Symlink("../a/b", path.Join(pkgdir, "d/l")); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tests := []struct {
+		relpath, linkname string
+		ok                bool
+	}{
+		{"link", "PKGBUILD", true},
+		{"a/b/link", "../../PKGBUILD", true},
+		{"a/link", "./b/../c", true},
+		{"link", ".", true},
+		{"link", "d/l", true},
+		{"d/link", "l", true},
+		{"link", "..", false},
+		{"a/link", "../../x", false},
+		{"link", "/etc/passwd", false},
+		{"link", "", false},
+		{"", "PKGBUILD", false},
+		{"link", "d/l/..", false},
+		{"link", "d/l/x", false},
+		{"d/link", "l/../..", false},
+		{"link", "nosuch/../PKGBUILD", false},
+		{"link", "a/PKGBUILD/..", false},
+	}
+	for _, test := range tests {
+		if err := checkLinkTarget(pkgdir, test.relpath, test.linkname); (err == nil) != test.ok {
+			t.Errorf("checkLinkTarget(%q, %q) = %v", test.relpath, test.linkname, err)
+		}
+	}
+}
+
+func TestClampFileTime(t *testing.T) {
+	tests := []struct{ secs, want int64 }{
+		{-1, 0},
+		{0, 0},
+		{1300000000, 1300000000},
+		{maxFileTime, maxFileTime},
+		{maxFileTime + 1, maxFileTime},
+		{1<<63 - 1, maxFileTime},
+	}
+	for _, test := range tests {
+		if secs := clampFileTime(test.secs); secs != test.want {
+			t.Errorf("clampFileTime(%d) = %d, want %d", test.secs, secs, test.want)
+		}
+	}
+
+	// Times past 2038 are kept where time_t is big enough for them.
+	var tv syscall.Timeval
+	if unsafe.Sizeof(tv.Sec) == 8 && clampFileTime(1<<32) != 1<<32 {
+		t.Errorf("clampFileTime(%d) = %d on a 64-bit system", int64(1<<32), clampFileTime(1<<32))
+	}
+}
+
+// buildWithList runs a PackageBuilder in a new temp dir, with makepkg faked to
+// list the package files names. The files in built are made by "makepkg".
+func buildWithList(t *testing.T, names, built []string) (string, *BuildResult, os.Error) {
+	dir := tempDir(t)
+	fake, restore := useFakeRunner()
+	defer restore()
+
+	list := ""
+	for _, name := range names {
+		list += path.Join(dir, name) + "\n"
+	}
+	fake.Results["makepkg --packagelist"] = &CmdResult{Stdout: []byte(list)}
+	for _, name := range built {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte("pkg"), 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	result, err := NewPackageBuilder(nil, nil).Build(NewCanceler(), dir)
+	checkRan(t, fake, "makepkg --packagelist", "makepkg -m -f -L")
+	return dir, result, err
+}
+
+// makepkg lists a -debug package even if there were no debug symbols to put in
+// it, like for arch=any packages.
+func TestBuildMissingDebug(t *testing.T) {
+	names := []string{"foo-1.0-1-any.pkg.tar.zst", "foo-debug-1.0-1-any.pkg.tar.zst"}
+	dir, result, err := buildWithList(t, names, names[:1])
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+	if len(result.PkgPaths) != 1 || result.PkgPaths[0] != path.Join(dir, names[0]) {
+		t.Errorf("built %v, want only %s", result.PkgPaths, names[0])
+	}
+}
+
+func TestBuildMissingPackage(t *testing.T) {
+	names := []string{"foo-1.0-1-any.pkg.tar.zst", "foo-docs-1.0-1-any.pkg.tar.zst"}
+	dir, _, err := buildWithList(t, names, names[:1])
+	defer os.RemoveAll(dir)
+	if err == nil {
+		t.Errorf("Build succeeded without %s", names[1])
+	}
+}
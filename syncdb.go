@@ -0,0 +1,190 @@
+/*	syncdb.go
+	Reading package entries from pacman's sync databases. We need these to
+	check that the package files we download are the ones the repo promised.
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"hash"
+	"path"
+	"bufio"
+	"strings"
+	"strconv"
+	"archive/tar"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"compress/gzip"
+)
+
+const (
+	DefaultDBPath = "/var/lib/pacman/"
+)
+
+// PkgDesc holds the fields of a pacman "desc" file, keyed by field name
+// without the percent signs (i.e. "NAME", "CSIZE", "SHA256SUM").
+type PkgDesc map[string][]string
+
+// Get returns the first value of the field, or "".
+func (desc PkgDesc) Get(field string) string {
+	vals := desc[field]
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+// ParsePkgDesc parses a desc file (or any file in the same format, like the
+// files list) from rdr. Each field starts with a %FIELD% line, followed by one
+// value per line, ending in a blank line.
+func ParsePkgDesc(rdr io.Reader) (PkgDesc, os.Error) {
+	desc := make(PkgDesc)
+	reader := bufio.NewReader(rdr)
+
+	var field string
+	for {
+		line, prefix, err := reader.ReadLine()
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if prefix {
+			return nil, os.NewError("Extremely long line in package description")
+		}
+
+		text := string(line)
+		switch {
+		case text == "":
+			field = ""
+		case field == "" && len(text) > 2 && text[0] == '%' && text[len(text)-1] == '%':
+			field = text[1 : len(text)-1]
+			desc[field] = []string{}
+		case field != "":
+			desc[field] = append(desc[field], text)
+		}
+	}
+
+	return desc, nil
+}
+
+// SyncDB is a repo's sync database, i.e. /var/lib/pacman/sync/core.db
+type SyncDB struct {
+	path string
+}
+
+// OpenSyncDB returns the sync database of the repo named reponame. If conf is
+// not nil, its DBPath setting is used.
+func OpenSyncDB(conf *PacmanConf, reponame string) *SyncDB {
+	dbpath := DefaultDBPath
+	if conf != nil && conf.Options.Get("DBPath") != "" {
+		dbpath = conf.Options.Get("DBPath")
+	}
+	return &SyncDB{path.Join(dbpath, "sync", reponame+".db")}
+}
+
+// entryPkgName extracts the package name from the name of the directory a
+// package's entries are in, which is <pkgname>-<pkgver>-<pkgrel>.
+func entryPkgName(dirname string) string {
+	for i := 0; i < 2; i++ {
+		idx := strings.LastIndex(dirname, "-")
+		if idx == -1 {
+			return ""
+		}
+		dirname = dirname[:idx]
+	}
+	return dirname
+}
+
+// FindFile returns the desc entry of the package pkgname whose package file is
+// named filename. Returns nil and no error if there is no such entry.
+func (db *SyncDB) FindFile(pkgname, filename string) (PkgDesc, os.Error) {
+	file, err := os.Open(db.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	unzipper, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer unzipper.Close()
+
+	rdr := tar.NewReader(unzipper)
+	for {
+		hdr, err := rdr.Next()
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		dir, name := path.Split(hdr.Name)
+		if name != "desc" || entryPkgName(strings.TrimRight(dir, "/")) != pkgname {
+			continue
+		}
+
+		desc, err := ParsePkgDesc(rdr)
+		if err != nil {
+			return nil, err
+		}
+		if desc.Get("FILENAME") == filename {
+			return desc, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// VerifyPkgFile checks that the size and checksum of the file at pkgpath match
+// what the package's desc entry says. The SHA256SUM is preferred, older
+// databases only have an MD5SUM.
+func VerifyPkgFile(desc PkgDesc, pkgpath string) os.Error {
+	stat, err := os.Stat(pkgpath)
+	if err != nil {
+		return err
+	}
+	if sizestr := desc.Get("CSIZE"); sizestr != "" {
+		size, err := strconv.Atoi64(sizestr)
+		if err != nil {
+			return os.NewError("Invalid CSIZE in sync database: " + sizestr)
+		}
+		if stat.Size != size {
+			msg := fmt.Sprintf("%s has the wrong size: %d bytes instead of %d",
+				path.Base(pkgpath), stat.Size, size)
+			return os.NewError(msg)
+		}
+	}
+
+	var hasher hash.Hash
+	var expected string
+	switch {
+	case desc.Get("SHA256SUM") != "":
+		hasher, expected = sha256.New(), desc.Get("SHA256SUM")
+	case desc.Get("MD5SUM") != "":
+		hasher, expected = md5.New(), desc.Get("MD5SUM")
+	default:
+		return os.NewError("No checksum for " + path.Base(pkgpath) + " in sync database")
+	}
+
+	file, err := os.Open(pkgpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum()); sum != strings.ToLower(expected) {
+		return os.NewError(path.Base(pkgpath) + " failed checksum verification")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+/*	tarball.go
+	Reading tarballs compressed in any of the ways makepkg compresses source
+	and binary packages. gzip and bzip2 are read in Go; there are no packages
+	for xz and zstd, so the xz and zstd commands decompress those for us.
+*/
+
+package main
+
+import (
+	"io"
+	"os"
+	"bytes"
+	"io/ioutil"
+	"archive/tar"
+	"compress/gzip"
+	"compress/bzip2"
+)
+
+// Magic numbers of the compression formats tarballs may use.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	tarMagic   = []byte("ustar") // at offset 257
+)
+
+// Decompressors we have no package for are run as commands.
+const (
+	XzPath   = "/usr/bin/xz"
+	ZstdPath = "/usr/bin/zstd"
+)
+
+// Tarball is an open tar file. Entries are read from it like from a
+// tar.Reader: Next moves to the next entry and Read reads its contents.
+type Tarball struct {
+	file   *os.File
+	decomp io.Reader     // nil for uncompressed tarballs
+	pipe   *os.File      // the stdout of the decompressor, if we run one
+	done   chan os.Error // gets the decompressor's error once it exits
+	err    os.Error      // the decompressor's error, once it was waited for
+	cn     *Canceler
+	reader *tar.Reader
+}
+
+// OpenTarball opens the tarball at tarpath. The compression is detected from
+// the file's contents: gzip, bzip2, xz, zstd or none at all. Decompressor
+// commands are run through CmdRunner with cn, so that they are killed if we
+// are canceled.
+func OpenTarball(cn *Canceler, tarpath string) (*Tarball, os.Error) {
+	file, err := os.Open(tarpath)
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, 262)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != os.EOF {
+		file.Close()
+		return nil, err
+	}
+	head = head[:n]
+	if _, err = file.Seek(0, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	tb := &Tarball{file: file, cn: cn}
+	var tarfile io.Reader
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		unzipper, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		tb.decomp, tarfile = unzipper, unzipper
+	case bytes.HasPrefix(head, bzip2Magic):
+		tb.decomp = bzip2.NewReader(file)
+		tarfile = tb.decomp
+	case bytes.HasPrefix(head, xzMagic):
+		err = tb.startDecompressor("xz")
+		tarfile = tb.pipe
+	case bytes.HasPrefix(head, zstdMagic):
+		err = tb.startDecompressor("zstd")
+		tarfile = tb.pipe
+	case len(head) == 262 && bytes.Equal(head[257:], tarMagic):
+		tarfile = file
+	default:
+		err = os.NewError(tarpath + " is not a tarball, or compressed in a way we don't know")
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	tb.reader = tar.NewReader(tarfile)
+	return tb, nil
+}
+
+// startDecompressor runs the decompressor command name with the tarball as its
+// stdin. What it writes to stdout is the tar file. The command runs until we
+// have read all of it, so it is waited for in the background.
+func (tb *Tarball) startDecompressor(name string) os.Error {
+	pipe, stdout, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd := &Command{Name: name, Args: []string{"-d", "-c"}, Stdin: tb.file,
+		Stdout: stdout, Quiet: true}
+	tb.pipe, tb.done = pipe, make(chan os.Error, 1)
+	go func() {
+		result, err := CmdRunner.Run(tb.cn, cmd)
+		// Once our copy of the write end is closed too, the reader gets EOF.
+		stdout.Close()
+		if err == nil {
+			err = result.Err(cmd)
+		}
+		tb.done <- err
+	}()
+	return nil
+}
+
+// wait waits for the decompressor to exit, if we run one, and returns its
+// error. The rest of its output is read first: xz and zstd only check the
+// integrity of the data at the end of it.
+func (tb *Tarball) wait() os.Error {
+	if tb.done == nil {
+		return tb.err
+	}
+	_, copyerr := io.Copy(ioutil.Discard, tb.pipe)
+	tb.err = <-tb.done
+	tb.done = nil
+	if tb.err == nil {
+		tb.err = copyerr
+	}
+	return tb.err
+}
+
+// Next moves to the next entry in the tarball. os.EOF is returned at the end,
+// unless the decompressor failed; its error is returned instead.
+func (tb *Tarball) Next() (*tar.Header, os.Error) {
+	hdr, err := tb.reader.Next()
+	if err == os.EOF || err == io.ErrUnexpectedEOF {
+		if werr := tb.wait(); werr != nil {
+			return nil, werr
+		}
+	}
+	return hdr, err
+}
+
+// Read reads the contents of the current entry. If the tarball ends too early
+// because the decompressor failed, its error is returned.
+func (tb *Tarball) Read(data []byte) (int, os.Error) {
+	n, err := tb.reader.Read(data)
+	if err == io.ErrUnexpectedEOF {
+		if werr := tb.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Close closes the tarball. If Next got to the end, the decompressor's error
+// is returned again. If we stopped reading early, the decompressor is stopped
+// by closing its stdout, and how it exits doesn't matter.
+func (tb *Tarball) Close() os.Error {
+	if closer, ok := tb.decomp.(io.Closer); ok {
+		closer.Close()
+	}
+	err := tb.err
+	if tb.done != nil {
+		tb.pipe.Close()
+		<-tb.done
+		tb.done = nil
+	}
+	tb.file.Close()
+	return err
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"archive/tar"
+)
+
+var tarballTestEntries = []tarEntry{
+	{Name: "foo/", Typeflag: tar.TypeDir},
+	{Name: "foo/PKGBUILD", Body: "pkgname=foo\n"},
+	{Name: "foo/big", Body: strings.Repeat("maw tarball test data\n", 10000)},
+}
+
+// compressWith compresses data with the command name, like makepkg would. It
+// returns nil if the command can't be run here.
+func compressWith(t *testing.T, name string, data []byte) []byte {
+	file, err := ioutil.TempFile("", "maw-test-")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err = file.Write(data); err == nil {
+		_, err = file.Seek(0, 0)
+	}
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	cmd := &Command{Name: name, Args: []string{"-c"}, Stdin: file, Capture: true, Quiet: true}
+	result, err := CmdRunner.Run(NewCanceler(), cmd)
+	if err != nil {
+		return nil
+	}
+	if err = result.Err(cmd); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return result.Stdout
+}
+
+// readTarball reads every entry of the tarball at tarpath, and returns their
+// names and the contents of the regular files.
+func readTarball(tarpath string) (map[string]string, os.Error) {
+	tb, err := OpenTarball(NewCanceler(), tarpath)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]string)
+	for {
+		hdr, err := tb.Next()
+		if err == os.EOF {
+			break
+		}
+		if err != nil {
+			tb.Close()
+			return entries, err
+		}
+		data, err := ioutil.ReadAll(tb)
+		if err != nil {
+			tb.Close()
+			return entries, err
+		}
+		entries[hdr.Name] = string(data)
+	}
+	return entries, tb.Close()
+}
+
+func TestTarballFormats(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	plain := tarBytes(t, tarballTestEntries)
+	tarballs := map[string][]byte{
+		"none":  plain,
+		"gzip":  tarballBytes(t, tarballTestEntries),
+		"bzip2": compressWith(t, "bzip2", plain),
+		"xz":    compressWith(t, "xz", plain),
+		"zstd":  compressWith(t, "zstd", plain),
+	}
+	for format, data := range tarballs {
+		if data == nil {
+			t.Logf("%s: can't compress, skipped", format)
+			continue
+		}
+		tarpath := path.Join(dir, "foo-"+format)
+		if err := ioutil.WriteFile(tarpath, data, 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+		entries, err := readTarball(tarpath)
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+			continue
+		}
+		if len(entries) != len(tarballTestEntries) {
+			t.Errorf("%s: read %d entries, want %d", format, len(entries),
+				len(tarballTestEntries))
+		}
+		for _, entry := range tarballTestEntries {
+			if body, ok := entries[entry.Name]; !ok || body != entry.Body {
+				t.Errorf("%s: %s has %d bytes, want %d", format, entry.Name, len(body),
+					len(entry.Body))
+			}
+		}
+	}
+}
+
+// xz checks the integrity of its data at the end. A tarball that is cut short
+// there is read completely, but the error must not go unnoticed.
+func TestTarballTruncated(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	data := compressWith(t, "xz", tarBytes(t, tarballTestEntries))
+	if data == nil {
+		t.Logf("can't run xz, skipped")
+		return
+	}
+	tarpath := path.Join(dir, "foo.tar.xz")
+	if err := ioutil.WriteFile(tarpath, data[:len(data)-8], 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := readTarball(tarpath); err == nil {
+		t.Errorf("read a truncated tarball without error")
+	}
+}
+
+func TestTarballDecompressorFails(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	fake, restore := useFakeRunner()
+	defer restore()
+	fake.Results["zstd"] = &CmdResult{ExitStatus: 1, Stderr: []byte("zstd: corrupted block\n")}
+
+	tarpath := path.Join(dir, "foo.tar.zst")
+	if err := ioutil.WriteFile(tarpath, append(zstdMagic, "garbage"...), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	tb, err := OpenTarball(NewCanceler(), tarpath)
+	if err != nil {
+		t.Fatalf("OpenTarball: %s", err)
+	}
+	if _, err = tb.Next(); err == nil || !strings.Contains(err.String(), "corrupted block") {
+		t.Errorf("Next: got %v, want zstd's error", err)
+	}
+	if err = tb.Close(); err == nil {
+		t.Errorf("Close: no error")
+	}
+	checkRan(t, fake, "zstd -d -c")
+}